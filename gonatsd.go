@@ -3,11 +3,16 @@
 package main
 
 import (
+	"bufio"
 	"flag"
 	"fmt"
 	"gonatsd/gonatsd"
+	"io"
 	"math/rand"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 )
 
@@ -18,6 +23,11 @@ func main() {
 
 	flag.Parse()
 
+	if flag.Arg(0) == "passwd" {
+		passwd(flag.Args()[1:])
+		return
+	}
+
 	config, err := gonatsd.ParseConfig(*configFilename)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Invalid config: %s\n", err.Error())
@@ -30,5 +40,55 @@ func main() {
 		os.Exit(1)
 	}
 
+	go handleSignals(server)
+
 	server.Start()
 }
+
+func handleSignals(server gonatsd.Server) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGUSR2, syscall.SIGHUP)
+	for sig := range signals {
+		switch sig {
+		case syscall.SIGHUP:
+			config, err := gonatsd.ParseConfig(*configFilename)
+			if err != nil {
+				gonatsd.Log.Warnf("Not reloading invalid config: %s", err.Error())
+				continue
+			}
+			server.Reload(config)
+		case syscall.SIGUSR2:
+			// Still shut down right away on SIGTERM while in lame duck mode.
+			go server.LameDuck(server.Config().Shutdown.LameDuckDuration)
+		default:
+			server.Shutdown(server.Config().Shutdown.TimeoutDuration)
+			return
+		}
+	}
+}
+
+// Reads a password from stdin and prints its hash for use in the config.
+func passwd(args []string) {
+	flags := flag.NewFlagSet("passwd", flag.ExitOnError)
+	cost := flags.Int("cost", gonatsd.DEFAULT_BCRYPT_COST, "bcrypt cost")
+	flags.Parse(args)
+
+	fmt.Fprint(os.Stderr, "Password: ")
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		fmt.Fprintf(os.Stderr, "Failed to read password: %s\n", err.Error())
+		os.Exit(1)
+	}
+	password = strings.TrimRight(password, "\r\n")
+	if len(password) == 0 {
+		fmt.Fprintf(os.Stderr, "No password given\n")
+		os.Exit(1)
+	}
+
+	hash, err := gonatsd.HashPassword(password, *cost)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to hash password: %s\n", err.Error())
+		os.Exit(1)
+	}
+	fmt.Println(hash)
+}
@@ -0,0 +1,101 @@
+// Copyright (c) 2012 VMware, Inc.
+
+package gonatsd
+
+import (
+	"fmt"
+)
+
+// Account of the users that don't belong to a configured account, and of
+// the routes. Only the global account is shared across the cluster.
+const GLOBAL_ACCOUNT = "$G"
+
+// An Account is an isolated subject namespace, messages published in it
+// only reach its own subscriptions and those of the accounts importing the
+// subject. It must only be used from the server loop, except for the
+// exports and imports that never change.
+type Account struct {
+	Name          string
+	Subscriptions *Trie
+	exports       *Trie
+	importers     *Trie // imported subject -> importing account
+}
+
+// Create an empty account.
+func NewAccount(name string) *Account {
+	return &Account{Name: name, Subscriptions: NewTrie("."), exports: NewTrie("."), importers: NewTrie(".")}
+}
+
+// Create the configured accounts along with the global one, and wire their
+// exports and imports.
+func NewAccounts(configs map[string]AccountConfig) (map[string]*Account, error) {
+	accounts := make(map[string]*Account)
+	accounts[GLOBAL_ACCOUNT] = NewAccount(GLOBAL_ACCOUNT)
+
+	for name, config := range configs {
+		if name == GLOBAL_ACCOUNT {
+			return nil, fmt.Errorf("account name '%s' is reserved", name)
+		}
+		account := NewAccount(name)
+		for _, subject := range config.Exports {
+			if !ensureValidSubscribedSubject(subject) {
+				return nil, fmt.Errorf("account '%s' has invalid export '%s'", name, subject)
+			}
+			account.exports.Insert(subject, true)
+		}
+		accounts[name] = account
+	}
+
+	for name, config := range configs {
+		for _, imported := range config.Imports {
+			exporter := accounts[imported.Account]
+			if imported.Account == name {
+				return nil, fmt.Errorf("account '%s' imports from itself", name)
+			}
+			if exporter == nil {
+				return nil, fmt.Errorf("account '%s' imports from unknown account '%s'", name,
+					imported.Account)
+			}
+			if !ensureValidSubscribedSubject(imported.Subject) {
+				return nil, fmt.Errorf("account '%s' has invalid import '%s'", name, imported.Subject)
+			}
+			if !exporter.Exports(imported.Subject) {
+				return nil, fmt.Errorf("account '%s' imports '%s' which '%s' doesn't export", name,
+					imported.Subject, imported.Account)
+			}
+			exporter.importers.Insert(imported.Subject, accounts[name])
+		}
+	}
+
+	return accounts, nil
+}
+
+// Returns true iff every subject matching the pattern is exported.
+func (a *Account) Exports(subject string) bool {
+	return len(a.exports.Match(subject, CoveringMatcher)) > 0
+}
+
+// Returns the other accounts that imported the published subject, each one
+// at most once.
+func (a *Account) Importers(subject string) []*Account {
+	matches := a.importers.Match(subject, WildcardMatcher)
+	if len(matches) == 0 {
+		return nil
+	}
+
+	importers := make([]*Account, 0, len(matches))
+	seen := make(map[*Account]bool)
+	for _, match := range matches {
+		account := match.(*Account)
+		if !seen[account] {
+			seen[account] = true
+			importers = append(importers, account)
+		}
+	}
+	return importers
+}
+
+// Returns true iff the account is shared across the cluster.
+func (a *Account) Global() bool {
+	return a.Name == GLOBAL_ACCOUNT
+}
@@ -0,0 +1,94 @@
+// Copyright (c) 2012 VMware, Inc.
+
+package gonatsd_test
+
+import (
+	"code.google.com/p/gomock/gomock"
+	. "gonatsd/gonatsd"
+	. "gonatsd/gonatsd/mocks"
+	. "launchpad.net/gocheck"
+)
+
+type AccountSuite struct{}
+
+var _ = Suite(&AccountSuite{})
+
+func newTestAccounts(c *C) map[string]*Account {
+	accounts, err := NewAccounts(map[string]AccountConfig{
+		"a": AccountConfig{Exports: []string{"public.>", "events.*"}},
+		"b": AccountConfig{Imports: []ImportConfig{{"a", "public.>"}, {"a", "public.foo"}}},
+		"c": AccountConfig{Imports: []ImportConfig{{"a", "events.foo"}}},
+	})
+	c.Assert(err, IsNil)
+	return accounts
+}
+
+func (s *AccountSuite) TestNewAccounts(c *C) {
+	accounts := newTestAccounts(c)
+	c.Check(accounts, HasLen, 4)
+	c.Check(accounts[GLOBAL_ACCOUNT].Global(), Equals, true)
+	c.Check(accounts["a"].Global(), Equals, false)
+	c.Check(accounts["a"].Name, Equals, "a")
+}
+
+func (s *AccountSuite) TestNewAccountsInvalid(c *C) {
+	configs := []map[string]AccountConfig{
+		{GLOBAL_ACCOUNT: AccountConfig{}},
+		{"a": AccountConfig{Exports: []string{"foo..bar"}}},
+		{"a": AccountConfig{Imports: []ImportConfig{{"b", "foo"}}}},
+		{"a": AccountConfig{Exports: []string{"foo"}, Imports: []ImportConfig{{"a", "foo"}}}},
+		{"a": AccountConfig{Exports: []string{"foo.*"}}, "b": AccountConfig{Imports: []ImportConfig{{"a", "foo.>"}}}},
+		{"a": AccountConfig{Exports: []string{"foo.*"}}, "b": AccountConfig{Imports: []ImportConfig{{"a", "bar"}}}},
+	}
+	for _, config := range configs {
+		_, err := NewAccounts(config)
+		c.Check(err, NotNil)
+	}
+}
+
+func (s *AccountSuite) TestExports(c *C) {
+	account := newTestAccounts(c)["a"]
+	c.Check(account.Exports("public.foo"), Equals, true)
+	c.Check(account.Exports("public.>"), Equals, true)
+	c.Check(account.Exports("events.foo"), Equals, true)
+	c.Check(account.Exports("events.>"), Equals, false)
+	c.Check(account.Exports("private"), Equals, false)
+}
+
+func (s *AccountSuite) TestImporters(c *C) {
+	accounts := newTestAccounts(c)
+	a := accounts["a"]
+	c.Check(a.Importers("public.foo"), DeepEquals, []*Account{accounts["b"]})
+	c.Check(a.Importers("events.foo"), DeepEquals, []*Account{accounts["c"]})
+	c.Check(a.Importers("events.bar"), HasLen, 0)
+	c.Check(accounts["b"].Importers("public.foo"), HasLen, 0)
+}
+
+func (s *AccountSuite) TestPublishCmd(c *C) {
+	ctrl := gomock.NewController(c)
+	defer ctrl.Finish()
+
+	accounts := newTestAccounts(c)
+	subscribe := func(account string, subject string) *Subscription {
+		subscription := &Subscription{Subject: subject, Account: accounts[account]}
+		accounts[account].Subscriptions.Insert(subject, subscription)
+		return subscription
+	}
+	own := subscribe("a", "public.foo")
+	imported := subscribe("b", "public.*")
+	subscribe("c", "public.foo")
+	subscribe(GLOBAL_ACCOUNT, "public.foo")
+
+	message := &Message{Subject: "public.foo"}
+	server := NewMockServer(ctrl)
+	server.EXPECT().Stats().Return(NewStats()).AnyTimes()
+	server.EXPECT().DeliverMessage(own, message)
+	server.EXPECT().DeliverMessage(imported, message)
+
+	(&PublishCmd{Message: message, Account: accounts["a"]}).Process(server)
+
+	// Imports only go one way
+	message = &Message{Subject: "public.foo"}
+	server.EXPECT().DeliverMessage(imported, message)
+	(&PublishCmd{Message: message, Account: accounts["b"]}).Process(server)
+}
@@ -0,0 +1,160 @@
+// Copyright (c) 2012 VMware, Inc.
+
+package gonatsd
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_CALLOUT_TIMEOUT   = 2 * time.Second
+	DEFAULT_CALLOUT_CACHE_TTL = 1 * time.Minute
+	MAX_CALLOUT_CACHE_SIZE    = 4096
+)
+
+// Credentials sent to the auth callout endpoint.
+type CalloutRequest struct {
+	User      string `json:"user,omitempty"`
+	Password  string `json:"pass,omitempty"`
+	AuthToken string `json:"auth_token,omitempty"`
+}
+
+// Decision returned by the auth callout endpoint. Allowed clients without
+// permissions may publish and subscribe to anything.
+type CalloutResponse struct {
+	Allow       bool               `json:"allow"`
+	Permissions *PermissionsConfig `json:"permissions"`
+}
+
+// Compiled decision of the auth callout endpoint.
+type CalloutResult struct {
+	Allow       bool
+	Permissions *Permissions
+}
+
+type calloutEntry struct {
+	result  *CalloutResult
+	expires time.Time
+}
+
+// AuthCallout delegates authentication to an HTTP endpoint, which gets the
+// credentials POSTed as JSON. Decisions are cached by credentials for the
+// cache TTL, failed calls are not.
+// It's shared by all connections and safe to use concurrently.
+type AuthCallout struct {
+	url    string
+	client *http.Client
+	ttl    time.Duration
+	lock   sync.Mutex
+	cache  map[[sha256.Size]byte]*calloutEntry
+}
+
+// Create an AuthCallout for the endpoint.
+func NewAuthCallout(url string, timeout time.Duration, ttl time.Duration) *AuthCallout {
+	return &AuthCallout{url: url, client: &http.Client{Timeout: timeout}, ttl: ttl,
+		cache: make(map[[sha256.Size]byte]*calloutEntry)}
+}
+
+// Returns the decision for the credentials of the request, an error if the
+// endpoint didn't answer in time or sent an invalid response.
+func (a *AuthCallout) Authenticate(request *ConnectRequest) (*CalloutResult, error) {
+	credentials := &CalloutRequest{}
+	if request.User != nil {
+		credentials.User = *request.User
+	}
+	if request.Password != nil {
+		credentials.Password = *request.Password
+	}
+	if request.AuthToken != nil {
+		credentials.AuthToken = *request.AuthToken
+	}
+
+	payload, err := json.Marshal(credentials)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only keep a hash of the credentials around.
+	key := sha256.Sum256(payload)
+	if result := a.cached(key); result != nil {
+		return result, nil
+	}
+
+	result, err := a.call(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	a.store(key, result)
+	return result, nil
+}
+
+func (a *AuthCallout) call(payload []byte) (*CalloutResult, error) {
+	resp, err := a.client.Post(a.url, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	response := &CalloutResponse{}
+	err = json.NewDecoder(resp.Body).Decode(response)
+	if err != nil {
+		return nil, fmt.Errorf("invalid response: %s", err.Error())
+	}
+
+	result := &CalloutResult{Allow: response.Allow}
+	if response.Allow && response.Permissions != nil {
+		result.Permissions, err = NewPermissions(response.Permissions)
+		if err != nil {
+			return nil, fmt.Errorf("invalid permissions: %s", err.Error())
+		}
+	}
+	return result, nil
+}
+
+func (a *AuthCallout) cached(key [sha256.Size]byte) *CalloutResult {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	entry, ok := a.cache[key]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(entry.expires) {
+		delete(a.cache, key)
+		return nil
+	}
+	return entry.result
+}
+
+func (a *AuthCallout) store(key [sha256.Size]byte, result *CalloutResult) {
+	if a.ttl <= 0 {
+		return
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	now := time.Now()
+	if len(a.cache) >= MAX_CALLOUT_CACHE_SIZE {
+		for key, entry := range a.cache {
+			if now.After(entry.expires) {
+				delete(a.cache, key)
+			}
+		}
+		if len(a.cache) >= MAX_CALLOUT_CACHE_SIZE {
+			a.cache = make(map[[sha256.Size]byte]*calloutEntry)
+		}
+	}
+	a.cache[key] = &calloutEntry{result, now.Add(a.ttl)}
+}
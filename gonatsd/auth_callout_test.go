@@ -0,0 +1,185 @@
+// Copyright (c) 2012 VMware, Inc.
+
+package gonatsd_test
+
+import (
+	"code.google.com/p/gomock/gomock"
+	"encoding/json"
+	. "gonatsd/gonatsd"
+	. "gonatsd/gonatsd/mocks"
+	. "launchpad.net/gocheck"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"time"
+)
+
+type AuthCalloutSuite struct {
+	server   *httptest.Server
+	requests int64
+	delay    time.Duration
+}
+
+var _ = Suite(&AuthCalloutSuite{})
+
+// Allows "foo" with permissions to publish to "foo.>" only, and the "secret"
+// token with no permissions.
+func (s *AuthCalloutSuite) SetUpTest(c *C) {
+	s.requests = 0
+	s.delay = 0
+	s.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&s.requests, 1)
+		time.Sleep(s.delay)
+
+		request := &CalloutRequest{}
+		err := json.NewDecoder(r.Body).Decode(request)
+		if err != nil || r.Method != "POST" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		switch {
+		case request.User == "foo" && request.Password == "bar":
+			w.Write([]byte(`{"allow": true, "permissions": {"publish": {"allow": ["foo.>"]}}}`))
+		case request.User == "invalid":
+			w.Write([]byte(`{"allow": true, "permissions": {"publish": {"allow": ["foo..bar"]}}}`))
+		case request.AuthToken == "secret":
+			w.Write([]byte(`{"allow": true}`))
+		case request.AuthToken == "broken":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.Write([]byte(`{"allow": false}`))
+		}
+	}))
+}
+
+func (s *AuthCalloutSuite) TearDownTest(c *C) {
+	s.server.Close()
+}
+
+func (s *AuthCalloutSuite) TestAuthenticate(c *C) {
+	foo, bar := "foo", "bar"
+	callout := NewAuthCallout(s.server.URL, time.Second, 0)
+
+	result, err := callout.Authenticate(&ConnectRequest{User: &foo, Password: &bar})
+	c.Check(err, IsNil)
+	c.Check(result.Allow, Equals, true)
+	c.Check(result.Permissions.Publish.Allowed("foo.bar"), Equals, true)
+	c.Check(result.Permissions.Publish.Allowed("bar"), Equals, false)
+
+	token := "secret"
+	result, err = callout.Authenticate(&ConnectRequest{AuthToken: &token})
+	c.Check(err, IsNil)
+	c.Check(result.Allow, Equals, true)
+	c.Check(result.Permissions, IsNil)
+
+	result, err = callout.Authenticate(&ConnectRequest{User: &foo, Password: &foo})
+	c.Check(err, IsNil)
+	c.Check(result.Allow, Equals, false)
+}
+
+func (s *AuthCalloutSuite) TestAuthenticateErrors(c *C) {
+	bar := "bar"
+	callout := NewAuthCallout(s.server.URL, time.Second, time.Minute)
+
+	token := "broken"
+	_, err := callout.Authenticate(&ConnectRequest{AuthToken: &token})
+	c.Check(err, ErrorMatches, "unexpected status: 500.*")
+
+	user := "invalid"
+	_, err = callout.Authenticate(&ConnectRequest{User: &user, Password: &bar})
+	c.Check(err, ErrorMatches, "invalid permissions: .*")
+
+	// Errors are not cached
+	_, err = callout.Authenticate(&ConnectRequest{AuthToken: &token})
+	c.Check(err, NotNil)
+	c.Check(atomic.LoadInt64(&s.requests), Equals, int64(3))
+}
+
+func (s *AuthCalloutSuite) TestAuthenticateTimeout(c *C) {
+	foo, bar := "foo", "bar"
+	s.delay = 100 * time.Millisecond
+	callout := NewAuthCallout(s.server.URL, 10*time.Millisecond, time.Minute)
+
+	_, err := callout.Authenticate(&ConnectRequest{User: &foo, Password: &bar})
+	c.Check(err, NotNil)
+}
+
+func (s *AuthCalloutSuite) TestAuthenticateCache(c *C) {
+	foo, bar := "foo", "bar"
+	callout := NewAuthCallout(s.server.URL, time.Second, time.Minute)
+
+	for i := 0; i < 3; i++ {
+		result, err := callout.Authenticate(&ConnectRequest{User: &foo, Password: &bar})
+		c.Check(err, IsNil)
+		c.Check(result.Allow, Equals, true)
+		result, err = callout.Authenticate(&ConnectRequest{User: &foo, Password: &foo})
+		c.Check(err, IsNil)
+		c.Check(result.Allow, Equals, false)
+	}
+	c.Check(atomic.LoadInt64(&s.requests), Equals, int64(2))
+
+	callout = NewAuthCallout(s.server.URL, time.Second, time.Millisecond)
+	callout.Authenticate(&ConnectRequest{User: &foo, Password: &bar})
+	time.Sleep(5 * time.Millisecond)
+	callout.Authenticate(&ConnectRequest{User: &foo, Password: &bar})
+	c.Check(atomic.LoadInt64(&s.requests), Equals, int64(4))
+}
+
+func (s *AuthCalloutSuite) TestAuthHelper(c *C) {
+	foo, bar := "foo", "bar"
+	ctrl := gomock.NewController(c)
+	defer ctrl.Finish()
+
+	conn := NewMockConn(ctrl)
+	conn.EXPECT().RemoteAddr().AnyTimes().Return(&DummyAddr{})
+	conn.EXPECT().PeerCertificates().AnyTimes().Return(nil)
+
+	config := &AuthConfig{Users: map[string]string{"baz": "qux"}}
+	config.Callout.Client = NewAuthCallout(s.server.URL, time.Second, 0)
+
+	helper := NewAuthHelper(conn, config)
+	defer helper.Stop()
+	authed, err := helper.Auth(&ConnectRequest{User: &foo, Password: &foo})
+	c.Check(authed, Equals, false)
+	c.Check(err, Equals, ErrAuthFailed)
+
+	authed, err = helper.Auth(&ConnectRequest{User: &foo, Password: &bar})
+	c.Check(authed, Equals, true)
+	c.Check(err, IsNil)
+	c.Check(helper.User(), Equals, "foo")
+	c.Check(helper.Permissions().Publish.Allowed("bar"), Equals, false)
+
+	// Permissions from the callout survive reloads
+	c.Check(helper.Reload(config), Equals, true)
+	c.Check(helper.Permissions(), NotNil)
+	c.Check(helper.Reload(&AuthConfig{Users: config.Users}), Equals, false)
+
+	// Local users don't go through the callout
+	user, password := "baz", "qux"
+	helper = NewAuthHelper(conn, config)
+	defer helper.Stop()
+	authed, err = helper.Auth(&ConnectRequest{User: &user, Password: &password})
+	c.Check(authed, Equals, true)
+	c.Check(atomic.LoadInt64(&s.requests), Equals, int64(2))
+}
+
+func (s *AuthCalloutSuite) TestAuthHelperTimeout(c *C) {
+	foo, bar := "foo", "bar"
+	ctrl := gomock.NewController(c)
+	defer ctrl.Finish()
+
+	conn := NewMockConn(ctrl)
+	conn.EXPECT().RemoteAddr().AnyTimes().Return(&DummyAddr{})
+	conn.EXPECT().PeerCertificates().AnyTimes().Return(nil)
+
+	s.delay = 100 * time.Millisecond
+	config := &AuthConfig{}
+	config.Callout.Client = NewAuthCallout(s.server.URL, 10*time.Millisecond, 0)
+
+	helper := NewAuthHelper(conn, config)
+	defer helper.Stop()
+	authed, err := helper.Auth(&ConnectRequest{User: &foo, Password: &bar})
+	c.Check(authed, Equals, false)
+	c.Check(err, Equals, ErrAuthFailed)
+}
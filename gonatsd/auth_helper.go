@@ -3,23 +3,59 @@
 package gonatsd
 
 import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"sync"
 	"time"
 )
 
+// Methods clients can authenticate with.
+const (
+	AUTH_USER        = "user"
+	AUTH_TOKEN       = "token"
+	AUTH_CERTIFICATE = "certificate"
+	AUTH_PUBLIC_KEY  = "public_key"
+	AUTH_CALLOUT     = "callout"
+
+	NONCE_SIZE = 16
+)
+
 type AuthHelper struct {
-	conn       Conn
-	users      map[string]string
-	timer      *time.Timer
-	channel    <-chan time.Time
-	authorized bool
-}
-
-// Create a new AuthHelper for the connection with the specified user map and auth timeout.
-func NewAuthHelper(conn Conn, users map[string]string, timeout time.Duration) *AuthHelper {
-	h := &AuthHelper{conn: conn, users: users}
-	if len(users) > 0 {
-		if timeout > 0 {
-			h.timer = time.NewTimer(timeout)
+	conn            Conn
+	users           map[string]string
+	certificates    map[string]string
+	tokens          []string
+	publicKeys      []string
+	nonce           string
+	userPermissions map[string]*Permissions
+	permissions     *Permissions
+	userAccounts    map[string]string
+	account         string
+	callout         *AuthCallout
+	lock            sync.Mutex
+	timer           *time.Timer
+	channel         <-chan time.Time
+	authorized      bool
+	user            string
+	method          string
+	token           string
+	publicKey       string
+}
+
+// Create a new AuthHelper for the connection with the specified auth config.
+func NewAuthHelper(conn Conn, config *AuthConfig) *AuthHelper {
+	h := &AuthHelper{conn: conn, users: config.Users, certificates: config.Certificates,
+		tokens: config.Tokens, publicKeys: config.PublicKeys, userPermissions: config.UserPermissions,
+		userAccounts: config.UserAccounts, callout: config.Callout.Client}
+	if len(h.publicKeys) > 0 {
+		h.nonce = newNonce()
+	}
+	if config.Required() {
+		if config.TimeoutDuration > 0 {
+			h.timer = time.NewTimer(config.TimeoutDuration)
 			h.channel = h.timer.C
 		}
 	} else {
@@ -35,21 +71,63 @@ func (h *AuthHelper) Auth(req Request) (bool, *NATSError) {
 		switch req.(type) {
 		case *ConnectRequest:
 			request := req.(*ConnectRequest)
-			if request.User == nil || request.Password == nil {
-				Log.Debugf("[client %s] did not send credentials", h.conn.RemoteAddr())
-				return false, ErrAuthRequired
+			if user, ok := h.certificateUser(); ok {
+				if request.User != nil && *request.User != user {
+					Log.Debugf("[client %s] certificate does not belong to: %s", h.conn.RemoteAddr(),
+						*request.User)
+					return false, ErrAuthFailed
+				}
+				Log.Debugf("[client %s] authenticated with certificate: %s", h.conn.RemoteAddr(), user)
+				h.authorize(AUTH_CERTIFICATE, user)
+				return true, nil
 			}
 
-			password, ok := h.users[*request.User]
-			if ok && password == *request.Password {
-				Log.Debugf("[client %s] authenticated with: %s", h.conn.RemoteAddr(), *request.User)
-				h.authorized = true
-				h.Stop()
+			if request.PublicKey != nil && len(h.nonce) > 0 {
+				if request.Signature == nil || !h.publicKeyAllowed(*request.PublicKey) ||
+					!verifyNonce(*request.PublicKey, *request.Signature, h.nonce) {
+					Log.Debugf("[client %s] sent wrong public key or signature", h.conn.RemoteAddr())
+					return false, ErrAuthFailed
+				}
+				Log.Debugf("[client %s] authenticated with public key: %s", h.conn.RemoteAddr(),
+					*request.PublicKey)
+				h.publicKey = *request.PublicKey
+				h.authorize(AUTH_PUBLIC_KEY, "")
 				return true, nil
-			} else {
-				Log.Debugf("[client %s] sent wrong credentials", h.conn.RemoteAddr())
-				return false, ErrAuthFailed
 			}
+
+			if request.AuthToken != nil && len(h.tokens) > 0 {
+				if h.tokenAllowed(*request.AuthToken) {
+					Log.Debugf("[client %s] authenticated with token", h.conn.RemoteAddr())
+					h.token = *request.AuthToken
+					h.authorize(AUTH_TOKEN, "")
+					return true, nil
+				}
+				if h.callout == nil {
+					Log.Debugf("[client %s] sent wrong token", h.conn.RemoteAddr())
+					return false, ErrAuthFailed
+				}
+			}
+
+			if request.User != nil && request.Password != nil {
+				password, ok := h.users[*request.User]
+				if ok && PasswordMatches(password, *request.Password) {
+					Log.Debugf("[client %s] authenticated with: %s", h.conn.RemoteAddr(), *request.User)
+					h.authorize(AUTH_USER, *request.User)
+					return true, nil
+				}
+			}
+
+			// Credentials unknown here are left to the callout.
+			if h.callout != nil {
+				return h.authCallout(request)
+			}
+
+			if request.User == nil || request.Password == nil {
+				Log.Debugf("[client %s] did not send credentials", h.conn.RemoteAddr())
+				return false, ErrAuthRequired
+			}
+			Log.Debugf("[client %s] sent wrong credentials", h.conn.RemoteAddr())
+			return false, ErrAuthFailed
 		default:
 			Log.Debugf("[client %s] did not send credentials", h.conn.RemoteAddr())
 			return false, ErrAuthRequired
@@ -58,6 +136,216 @@ func (h *AuthHelper) Auth(req Request) (bool, *NATSError) {
 	return true, nil
 }
 
+// Authenticate the request with the callout endpoint.
+// It blocks the dispatch loop of this connection only, for at most the
+// callout timeout.
+func (h *AuthHelper) authCallout(request *ConnectRequest) (bool, *NATSError) {
+	result, err := h.callout.Authenticate(request)
+	if err != nil {
+		Log.Warnf("[client %s] auth callout failed: %s", h.conn.RemoteAddr(), err)
+		return false, ErrAuthFailed
+	}
+
+	if !result.Allow {
+		Log.Debugf("[client %s] denied by auth callout", h.conn.RemoteAddr())
+		return false, ErrAuthFailed
+	}
+
+	user := ""
+	if request.User != nil {
+		user = *request.User
+	}
+	Log.Debugf("[client %s] authenticated with callout: %s", h.conn.RemoteAddr(), user)
+	h.authorize(AUTH_CALLOUT, user)
+	h.setPermissions(result.Permissions)
+	return true, nil
+}
+
+// Returns the nonce the client has to sign to authenticate with a public
+// key, empty if no public keys are allowed.
+func (h *AuthHelper) Nonce() string {
+	return h.nonce
+}
+
+// Returns the authenticated user, empty if auth is not required or didn't
+// happen yet.
+func (h *AuthHelper) User() string {
+	return h.user
+}
+
+// Returns the account of the authenticated user, empty for the global
+// account.
+// Safe to call from the read loop.
+func (h *AuthHelper) Account() string {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.account
+}
+
+// Switch to a reloaded auth config.
+// Returns false iff the connection already authenticated as a user that is
+// no longer allowed, or didn't authenticate while auth is now required.
+// Connections that are still authenticating use the new users and are left
+// to the auth timeout.
+func (h *AuthHelper) Reload(config *AuthConfig) bool {
+	h.users = config.Users
+	h.certificates = config.Certificates
+	h.tokens = config.Tokens
+	h.publicKeys = config.PublicKeys
+	h.userPermissions = config.UserPermissions
+	h.callout = config.Callout.Client
+	h.lock.Lock()
+	h.userAccounts = config.UserAccounts
+	if h.authorized {
+		h.account = h.userAccounts[h.user]
+	}
+	h.lock.Unlock()
+	if !h.authorized {
+		return true
+	}
+
+	// Callout permissions stay until the client reconnects.
+	if h.method != AUTH_CALLOUT {
+		h.setPermissions(h.userPermissions[h.user])
+	}
+
+	switch h.method {
+	case AUTH_CERTIFICATE:
+		user, ok := h.certificateUser()
+		return ok && user == h.user
+	case AUTH_TOKEN:
+		return h.tokenAllowed(h.token)
+	case AUTH_PUBLIC_KEY:
+		return h.publicKeyAllowed(h.publicKey)
+	case AUTH_USER:
+		_, ok := h.users[h.user]
+		return ok
+	case AUTH_CALLOUT:
+		return h.callout != nil
+	}
+	return !config.Required()
+}
+
+// Returns true iff the token matches one of the configured tokens, which
+// are either bcrypt hashes or plain text.
+func (h *AuthHelper) tokenAllowed(token string) bool {
+	for _, configured := range h.tokens {
+		if PasswordMatches(configured, token) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the permissions of the authenticated user, nil if the user may
+// publish and subscribe to anything.
+// Safe to call from the read loop.
+func (h *AuthHelper) Permissions() *Permissions {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.permissions
+}
+
+func (h *AuthHelper) setPermissions(permissions *Permissions) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.permissions = permissions
+}
+
+// Returns true iff the public key is one of the configured ones.
+func (h *AuthHelper) publicKeyAllowed(publicKey string) bool {
+	key, err := DecodePublicKey(publicKey)
+	if err != nil {
+		return false
+	}
+	for _, configured := range h.publicKeys {
+		allowed, err := DecodePublicKey(configured)
+		if err == nil && allowed.Equal(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// Decode a base64 (URL alphabet, unpadded) ed25519 public key.
+func DecodePublicKey(publicKey string) (ed25519.PublicKey, error) {
+	key, err := base64.RawURLEncoding.DecodeString(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("public key must be %d bytes", ed25519.PublicKeySize)
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// Returns true iff the signature, base64 (URL alphabet, unpadded) encoded,
+// is the nonce signed by the public key.
+func verifyNonce(publicKey, signature, nonce string) bool {
+	key, err := DecodePublicKey(publicKey)
+	if err != nil {
+		return false
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	return ed25519.Verify(key, []byte(nonce), sig)
+}
+
+func newNonce() string {
+	nonce := make([]byte, NONCE_SIZE)
+	rand.Read(nonce)
+	return base64.RawURLEncoding.EncodeToString(nonce)
+}
+
+func (h *AuthHelper) authorize(method, user string) {
+	h.authorized = true
+	h.method = method
+	h.user = user
+	h.setPermissions(h.userPermissions[user])
+	h.lock.Lock()
+	h.account = h.userAccounts[user]
+	h.lock.Unlock()
+	h.Stop()
+}
+
+// Returns the user mapped to the verified client certificate, matching the
+// subject common name first and then the subject alternative names.
+func (h *AuthHelper) certificateUser() (string, bool) {
+	if len(h.certificates) == 0 {
+		return "", false
+	}
+
+	certs := h.conn.PeerCertificates()
+	if len(certs) == 0 {
+		return "", false
+	}
+
+	for _, name := range certificateNames(certs[0]) {
+		if user, ok := h.certificates[name]; ok {
+			return user, true
+		}
+	}
+	return "", false
+}
+
+func certificateNames(cert *x509.Certificate) []string {
+	names := make([]string, 0, 1+len(cert.DNSNames)+len(cert.EmailAddresses))
+	if len(cert.Subject.CommonName) > 0 {
+		names = append(names, cert.Subject.CommonName)
+	}
+	names = append(names, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+	return names
+}
+
 // Stop the AuthHelper.
 // Must be called to cleanup the internal timers.
 func (h *AuthHelper) Stop() {
@@ -4,6 +4,11 @@ package gonatsd_test
 
 import (
 	"code.google.com/p/gomock/gomock"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
 	. "gonatsd/gonatsd"
 	. "gonatsd/gonatsd/mocks"
 	. "launchpad.net/gocheck"
@@ -19,7 +24,7 @@ func (s *AuthHelperSuite) TestNoAuth(c *C) {
 
 	conn := NewMockConn(ctrl)
 	conn.EXPECT().RemoteAddr().AnyTimes().Return(&DummyAddr{})
-	helper := NewAuthHelper(conn, map[string]string{}, 0)
+	helper := NewAuthHelper(conn, &AuthConfig{Users: map[string]string{}})
 	defer helper.Stop()
 
 	authed, err := helper.Auth(PING_REQUEST)
@@ -33,7 +38,7 @@ func (s *AuthHelperSuite) TestAuth(c *C) {
 
 	conn := NewMockConn(ctrl)
 	conn.EXPECT().RemoteAddr().AnyTimes().Return(&DummyAddr{})
-	helper := NewAuthHelper(conn, map[string]string{"foo": "bar"}, 0)
+	helper := NewAuthHelper(conn, &AuthConfig{Users: map[string]string{"foo": "bar"}})
 	defer helper.Stop()
 
 	user := "foo"
@@ -42,6 +47,7 @@ func (s *AuthHelperSuite) TestAuth(c *C) {
 	authed, err := helper.Auth(&ConnectRequest{User: &user, Password: &password})
 	c.Check(authed, Equals, true)
 	c.Check(err, IsNil)
+	c.Check(helper.User(), Equals, "foo")
 
 	// Check to make sure further requests don't need to be authed
 	authed, err = helper.Auth(PING_REQUEST)
@@ -49,13 +55,37 @@ func (s *AuthHelperSuite) TestAuth(c *C) {
 	c.Check(err, IsNil)
 }
 
+func (s *AuthHelperSuite) TestAuthHash(c *C) {
+	ctrl := gomock.NewController(c)
+	defer ctrl.Finish()
+
+	hash, err := HashPassword("bar", 4)
+	c.Assert(err, IsNil)
+
+	conn := NewMockConn(ctrl)
+	conn.EXPECT().RemoteAddr().AnyTimes().Return(&DummyAddr{})
+	helper := NewAuthHelper(conn, &AuthConfig{Users: map[string]string{"foo": hash}})
+	defer helper.Stop()
+
+	user := "foo"
+	password := "baz"
+	authed, authErr := helper.Auth(&ConnectRequest{User: &user, Password: &password})
+	c.Check(authed, Equals, false)
+	c.Check(authErr, Equals, ErrAuthFailed)
+
+	password = "bar"
+	authed, authErr = helper.Auth(&ConnectRequest{User: &user, Password: &password})
+	c.Check(authed, Equals, true)
+	c.Check(authErr, IsNil)
+}
+
 func (s *AuthHelperSuite) TestNoCreds(c *C) {
 	ctrl := gomock.NewController(c)
 	defer ctrl.Finish()
 
 	conn := NewMockConn(ctrl)
 	conn.EXPECT().RemoteAddr().AnyTimes().Return(&DummyAddr{})
-	helper := NewAuthHelper(conn, map[string]string{"foo": "bar"}, 0)
+	helper := NewAuthHelper(conn, &AuthConfig{Users: map[string]string{"foo": "bar"}})
 	defer helper.Stop()
 
 	authed, err := helper.Auth(new(ConnectRequest))
@@ -69,7 +99,7 @@ func (s *AuthHelperSuite) TestNoConnectReq(c *C) {
 
 	conn := NewMockConn(ctrl)
 	conn.EXPECT().RemoteAddr().AnyTimes().Return(&DummyAddr{})
-	helper := NewAuthHelper(conn, map[string]string{"foo": "bar"}, 0)
+	helper := NewAuthHelper(conn, &AuthConfig{Users: map[string]string{"foo": "bar"}})
 	defer helper.Stop()
 
 	authed, err := helper.Auth(PING_REQUEST)
@@ -83,7 +113,7 @@ func (s *AuthHelperSuite) TestWrongCreds(c *C) {
 
 	conn := NewMockConn(ctrl)
 	conn.EXPECT().RemoteAddr().AnyTimes().Return(&DummyAddr{})
-	helper := NewAuthHelper(conn, map[string]string{"foo": "bar"}, 0)
+	helper := NewAuthHelper(conn, &AuthConfig{Users: map[string]string{"foo": "bar"}})
 	defer helper.Stop()
 
 	user := "foo"
@@ -100,7 +130,7 @@ func (s *AuthHelperSuite) TestTimer(c *C) {
 
 	conn := NewMockConn(ctrl)
 	conn.EXPECT().RemoteAddr().AnyTimes().Return(&DummyAddr{})
-	helper := NewAuthHelper(conn, map[string]string{"foo": "bar"}, 1)
+	helper := NewAuthHelper(conn, &AuthConfig{Users: map[string]string{"foo": "bar"}, TimeoutDuration: 1})
 	defer helper.Stop()
 
 	c.Check(helper.Timer(), NotNil)
@@ -112,7 +142,7 @@ func (s *AuthHelperSuite) TestNoTimer(c *C) {
 
 	conn := NewMockConn(ctrl)
 	conn.EXPECT().RemoteAddr().AnyTimes().Return(&DummyAddr{})
-	helper := NewAuthHelper(conn, map[string]string{"foo": "bar"}, 0)
+	helper := NewAuthHelper(conn, &AuthConfig{Users: map[string]string{"foo": "bar"}})
 	defer helper.Stop()
 
 	c.Check(helper.Timer(), IsNil)
@@ -124,7 +154,7 @@ func (s *AuthHelperSuite) TestStop(c *C) {
 
 	conn := NewMockConn(ctrl)
 	conn.EXPECT().RemoteAddr().AnyTimes().Return(&DummyAddr{})
-	helper := NewAuthHelper(conn, map[string]string{"foo": "bar"}, 1)
+	helper := NewAuthHelper(conn, &AuthConfig{Users: map[string]string{"foo": "bar"}, TimeoutDuration: 1})
 	c.Check(helper.Timer(), NotNil)
 	helper.Stop()
 	c.Check(helper.Timer(), IsNil)
@@ -137,8 +167,295 @@ func (s *AuthHelperSuite) TestTimeout(c *C) {
 	conn := NewMockConn(ctrl)
 	conn.EXPECT().RemoteAddr().AnyTimes().Return(&DummyAddr{})
 	conn.EXPECT().CloseWithError(ErrAuthRequired)
-	helper := NewAuthHelper(conn, map[string]string{"foo": "bar"}, 1)
+	helper := NewAuthHelper(conn, &AuthConfig{Users: map[string]string{"foo": "bar"}, TimeoutDuration: 1})
 	defer helper.Stop()
 
 	helper.Timeout()
 }
+
+func newCertAuthHelper(ctrl *gomock.Controller, cert *x509.Certificate) *AuthHelper {
+	conn := NewMockConn(ctrl)
+	conn.EXPECT().RemoteAddr().AnyTimes().Return(&DummyAddr{})
+	if cert != nil {
+		conn.EXPECT().PeerCertificates().AnyTimes().Return([]*x509.Certificate{cert})
+	} else {
+		conn.EXPECT().PeerCertificates().AnyTimes().Return(nil)
+	}
+	return NewAuthHelper(conn, &AuthConfig{
+		Users:        map[string]string{"foo": "bar"},
+		Certificates: map[string]string{"svc.example.com": "svc", "api.example.com": "foo"},
+	})
+}
+
+func (s *AuthHelperSuite) TestCertAuth(c *C) {
+	ctrl := gomock.NewController(c)
+	defer ctrl.Finish()
+
+	helper := newCertAuthHelper(ctrl, &x509.Certificate{Subject: pkix.Name{CommonName: "svc.example.com"}})
+	defer helper.Stop()
+
+	authed, err := helper.Auth(new(ConnectRequest))
+	c.Check(authed, Equals, true)
+	c.Check(err, IsNil)
+	c.Check(helper.User(), Equals, "svc")
+}
+
+func (s *AuthHelperSuite) TestCertAuthSAN(c *C) {
+	ctrl := gomock.NewController(c)
+	defer ctrl.Finish()
+
+	helper := newCertAuthHelper(ctrl, &x509.Certificate{Subject: pkix.Name{CommonName: "unknown"},
+		DNSNames: []string{"other.example.com", "api.example.com"}})
+	defer helper.Stop()
+
+	user := "foo"
+	authed, err := helper.Auth(&ConnectRequest{User: &user})
+	c.Check(authed, Equals, true)
+	c.Check(err, IsNil)
+	c.Check(helper.User(), Equals, "foo")
+}
+
+func (s *AuthHelperSuite) TestCertAuthWrongUser(c *C) {
+	ctrl := gomock.NewController(c)
+	defer ctrl.Finish()
+
+	helper := newCertAuthHelper(ctrl, &x509.Certificate{Subject: pkix.Name{CommonName: "svc.example.com"}})
+	defer helper.Stop()
+
+	user := "foo"
+	password := "bar"
+	authed, err := helper.Auth(&ConnectRequest{User: &user, Password: &password})
+	c.Check(authed, Equals, false)
+	c.Check(err, Equals, ErrAuthFailed)
+}
+
+func (s *AuthHelperSuite) TestCertAuthUnknownCert(c *C) {
+	ctrl := gomock.NewController(c)
+	defer ctrl.Finish()
+
+	helper := newCertAuthHelper(ctrl, &x509.Certificate{Subject: pkix.Name{CommonName: "unknown"}})
+	defer helper.Stop()
+
+	authed, err := helper.Auth(new(ConnectRequest))
+	c.Check(authed, Equals, false)
+	c.Check(err, Equals, ErrAuthRequired)
+}
+
+func (s *AuthHelperSuite) TestCertAuthNoCertFallback(c *C) {
+	ctrl := gomock.NewController(c)
+	defer ctrl.Finish()
+
+	helper := newCertAuthHelper(ctrl, nil)
+	defer helper.Stop()
+
+	user := "foo"
+	password := "bar"
+	authed, err := helper.Auth(&ConnectRequest{User: &user, Password: &password})
+	c.Check(authed, Equals, true)
+	c.Check(err, IsNil)
+}
+
+func (s *AuthHelperSuite) TestReload(c *C) {
+	ctrl := gomock.NewController(c)
+	defer ctrl.Finish()
+
+	conn := NewMockConn(ctrl)
+	conn.EXPECT().RemoteAddr().AnyTimes().Return(&DummyAddr{})
+	helper := NewAuthHelper(conn, &AuthConfig{Users: map[string]string{"foo": "bar"}})
+	defer helper.Stop()
+
+	user := "foo"
+	password := "bar"
+	helper.Auth(&ConnectRequest{User: &user, Password: &password})
+
+	c.Check(helper.Reload(&AuthConfig{Users: map[string]string{"foo": "baz", "bar": "baz"}}), Equals, true)
+	c.Check(helper.Reload(&AuthConfig{Users: map[string]string{"bar": "baz"}}), Equals, false)
+}
+
+func (s *AuthHelperSuite) TestReloadAccounts(c *C) {
+	ctrl := gomock.NewController(c)
+	defer ctrl.Finish()
+
+	conn := NewMockConn(ctrl)
+	conn.EXPECT().RemoteAddr().AnyTimes().Return(&DummyAddr{})
+	users := map[string]string{"foo": "bar", "bar": "baz"}
+	helper := NewAuthHelper(conn, &AuthConfig{Users: users, UserAccounts: map[string]string{"foo": "a"}})
+	defer helper.Stop()
+
+	user := "foo"
+	password := "bar"
+	helper.Auth(&ConnectRequest{User: &user, Password: &password})
+	c.Check(helper.Account(), Equals, "a")
+
+	c.Check(helper.Reload(&AuthConfig{Users: users, UserAccounts: map[string]string{"foo": "b"}}), Equals, true)
+	c.Check(helper.Account(), Equals, "b")
+}
+
+func (s *AuthHelperSuite) TestReloadNewUser(c *C) {
+	ctrl := gomock.NewController(c)
+	defer ctrl.Finish()
+
+	conn := NewMockConn(ctrl)
+	conn.EXPECT().RemoteAddr().AnyTimes().Return(&DummyAddr{})
+	helper := NewAuthHelper(conn, &AuthConfig{Users: map[string]string{"foo": "bar"}})
+	defer helper.Stop()
+
+	// Not authenticated yet, so the new users apply
+	c.Check(helper.Reload(&AuthConfig{Users: map[string]string{"bar": "baz"}}), Equals, true)
+
+	user := "bar"
+	password := "baz"
+	authed, err := helper.Auth(&ConnectRequest{User: &user, Password: &password})
+	c.Check(authed, Equals, true)
+	c.Check(err, IsNil)
+}
+
+func (s *AuthHelperSuite) TestReloadAuthRequired(c *C) {
+	ctrl := gomock.NewController(c)
+	defer ctrl.Finish()
+
+	conn := NewMockConn(ctrl)
+	helper := NewAuthHelper(conn, &AuthConfig{})
+	defer helper.Stop()
+
+	c.Check(helper.Reload(&AuthConfig{}), Equals, true)
+	c.Check(helper.Reload(&AuthConfig{Users: map[string]string{"foo": "bar"}}), Equals, false)
+}
+
+func (s *AuthHelperSuite) TestReloadCertAuth(c *C) {
+	ctrl := gomock.NewController(c)
+	defer ctrl.Finish()
+
+	helper := newCertAuthHelper(ctrl, &x509.Certificate{Subject: pkix.Name{CommonName: "svc.example.com"}})
+	defer helper.Stop()
+
+	helper.Auth(new(ConnectRequest))
+
+	c.Check(helper.Reload(&AuthConfig{Certificates: map[string]string{"svc.example.com": "svc"}}), Equals, true)
+	c.Check(helper.Reload(&AuthConfig{Certificates: map[string]string{"svc.example.com": "foo"}}), Equals, false)
+}
+
+func (s *AuthHelperSuite) TestTokenAuth(c *C) {
+	ctrl := gomock.NewController(c)
+	defer ctrl.Finish()
+
+	hash, err := HashPassword("t2", 4)
+	c.Assert(err, IsNil)
+
+	conn := NewMockConn(ctrl)
+	conn.EXPECT().RemoteAddr().AnyTimes().Return(&DummyAddr{})
+	conn.EXPECT().PeerCertificates().AnyTimes().Return(nil)
+	config := &AuthConfig{Users: map[string]string{"foo": "bar"}, Tokens: []string{"t1", hash}}
+
+	for _, token := range []string{"t1", "t2"} {
+		helper := NewAuthHelper(conn, config)
+		authed, authErr := helper.Auth(&ConnectRequest{AuthToken: &token})
+		c.Check(authed, Equals, true)
+		c.Check(authErr, IsNil)
+		c.Check(helper.User(), Equals, "")
+		helper.Stop()
+	}
+
+	token := "t3"
+	helper := NewAuthHelper(conn, config)
+	defer helper.Stop()
+	authed, authErr := helper.Auth(&ConnectRequest{AuthToken: &token})
+	c.Check(authed, Equals, false)
+	c.Check(authErr, Equals, ErrAuthFailed)
+}
+
+func (s *AuthHelperSuite) TestReloadTokenAuth(c *C) {
+	ctrl := gomock.NewController(c)
+	defer ctrl.Finish()
+
+	conn := NewMockConn(ctrl)
+	conn.EXPECT().RemoteAddr().AnyTimes().Return(&DummyAddr{})
+	conn.EXPECT().PeerCertificates().AnyTimes().Return(nil)
+	config := &AuthConfig{Users: map[string]string{"foo": "bar"}, Tokens: []string{"t1"}}
+
+	token := "t1"
+	tokenHelper := NewAuthHelper(conn, config)
+	defer tokenHelper.Stop()
+	tokenHelper.Auth(&ConnectRequest{AuthToken: &token})
+
+	user, password := "foo", "bar"
+	userHelper := NewAuthHelper(conn, config)
+	defer userHelper.Stop()
+	userHelper.Auth(&ConnectRequest{User: &user, Password: &password})
+
+	// Revoking the token keeps user/password clients
+	reloaded := &AuthConfig{Users: map[string]string{"foo": "bar"}, Tokens: []string{"t2"}}
+	c.Check(tokenHelper.Reload(reloaded), Equals, false)
+	c.Check(userHelper.Reload(reloaded), Equals, true)
+}
+
+func newTestKey(c *C) (string, ed25519.PrivateKey) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	c.Assert(err, IsNil)
+	return base64.RawURLEncoding.EncodeToString(public), private
+}
+
+func signNonce(private ed25519.PrivateKey, nonce string) string {
+	return base64.RawURLEncoding.EncodeToString(ed25519.Sign(private, []byte(nonce)))
+}
+
+func (s *AuthHelperSuite) TestPublicKeyAuth(c *C) {
+	ctrl := gomock.NewController(c)
+	defer ctrl.Finish()
+
+	publicKey, privateKey := newTestKey(c)
+	otherKey, otherPrivateKey := newTestKey(c)
+
+	conn := NewMockConn(ctrl)
+	conn.EXPECT().RemoteAddr().AnyTimes().Return(&DummyAddr{})
+	conn.EXPECT().PeerCertificates().AnyTimes().Return(nil)
+	config := &AuthConfig{PublicKeys: []string{publicKey}}
+
+	helper := NewAuthHelper(conn, config)
+	defer helper.Stop()
+	c.Assert(helper.Nonce(), Not(Equals), "")
+
+	// Signed by another key
+	sig := signNonce(otherPrivateKey, helper.Nonce())
+	authed, err := helper.Auth(&ConnectRequest{PublicKey: &publicKey, Signature: &sig})
+	c.Check(authed, Equals, false)
+	c.Check(err, Equals, ErrAuthFailed)
+
+	// Key not allowed
+	sig = signNonce(otherPrivateKey, helper.Nonce())
+	authed, err = helper.Auth(&ConnectRequest{PublicKey: &otherKey, Signature: &sig})
+	c.Check(authed, Equals, false)
+	c.Check(err, Equals, ErrAuthFailed)
+
+	// Signed another nonce
+	sig = signNonce(privateKey, "nonce")
+	authed, err = helper.Auth(&ConnectRequest{PublicKey: &publicKey, Signature: &sig})
+	c.Check(authed, Equals, false)
+	c.Check(err, Equals, ErrAuthFailed)
+
+	sig = signNonce(privateKey, helper.Nonce())
+	authed, err = helper.Auth(&ConnectRequest{PublicKey: &publicKey, Signature: &sig})
+	c.Check(authed, Equals, true)
+	c.Check(err, IsNil)
+
+	c.Check(helper.Reload(config), Equals, true)
+	c.Check(helper.Reload(&AuthConfig{PublicKeys: []string{otherKey}}), Equals, false)
+}
+
+func (s *AuthHelperSuite) TestNonce(c *C) {
+	ctrl := gomock.NewController(c)
+	defer ctrl.Finish()
+
+	publicKey, _ := newTestKey(c)
+	conn := NewMockConn(ctrl)
+
+	helper := NewAuthHelper(conn, &AuthConfig{Users: map[string]string{"foo": "bar"}})
+	c.Check(helper.Nonce(), Equals, "")
+	helper.Stop()
+
+	helper = NewAuthHelper(conn, &AuthConfig{PublicKeys: []string{publicKey}})
+	other := NewAuthHelper(conn, &AuthConfig{PublicKeys: []string{publicKey}})
+	c.Check(helper.Nonce(), Not(Equals), other.Nonce())
+	helper.Stop()
+	other.Stop()
+}
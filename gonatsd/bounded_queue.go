@@ -74,6 +74,11 @@ func (q *BoundedQueue) Dequeue() (HasSize, error) {
 	return o, nil
 }
 
+// Returns the current queue size.
+func (q *BoundedQueue) Size() int32 {
+	return atomic.LoadInt32(&q.totalSize)
+}
+
 // Returns true if the queue has more elements to dequeue without blocking.
 func (q *BoundedQueue) HasMore() bool {
 	if q.closed {
@@ -60,6 +60,19 @@ func (s *BoundedQueueSuite) TestEnqueueFull(c *C) {
 	c.Check(err, Equals, ErrQueueFull)
 }
 
+func (s *BoundedQueueSuite) TestSize(c *C) {
+	q := NewBoundedQueue(10)
+	defer q.Close()
+
+	c.Check(q.Size(), Equals, int32(0))
+	q.Enqueue(&DummySizedObject{3})
+	q.Enqueue(&DummySizedObject{4})
+	c.Check(q.Size(), Equals, int32(7))
+
+	q.Dequeue()
+	c.Check(q.Size(), Equals, int32(4))
+}
+
 func (s *BoundedQueueSuite) TestDequeueClosed(c *C) {
 	q := NewBoundedQueue(10)
 	q.Close()
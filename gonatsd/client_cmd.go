@@ -30,6 +30,64 @@ func (c *ErrorCmd) Process(conn Conn) {
 	}
 }
 
+// Close the connection and send the error to the client.
+type CloseWithErrorCmd struct {
+	Error *NATSError
+}
+
+func (c *CloseWithErrorCmd) Process(conn Conn) {
+	conn.CloseWithError(c.Error)
+}
+
+// Send the current server INFO to the client.
+type InfoCmd struct {
+}
+
+func (c *InfoCmd) Process(conn Conn) {
+	if !conn.Closed() {
+		conn.Write(INFO_REQUEST.Serve(conn))
+	}
+}
+
+// Push an updated server INFO to the client, if it said in CONNECT that it
+// understands unsolicited INFO.
+type InfoUpdateCmd struct {
+}
+
+func (c *InfoUpdateCmd) Process(conn Conn) {
+	if !conn.Closed() && conn.Options().Protocol >= PROTOCOL_DYNAMIC {
+		conn.Write(INFO_REQUEST.Serve(conn))
+	}
+}
+
+// Apply a reloaded auth config, closing the connection if its user was
+// removed.
+type ReloadAuthCmd struct {
+	Auth *AuthConfig
+}
+
+func (c *ReloadAuthCmd) Process(conn Conn) {
+	if !conn.Closed() && !conn.AuthHelper().Reload(c.Auth) {
+		Log.Infof("[client %s] user no longer allowed: %s", conn.RemoteAddr(), conn.AuthHelper().User())
+		conn.CloseWithError(ErrAuthRevoked)
+	}
+}
+
+// Take a snapshot of the connection for /connz, nil once it's closed.
+type ConnInfoCmd struct {
+	Info chan *ConnInfo
+}
+
+func (c *ConnInfoCmd) Process(conn Conn) {
+	if conn.Closed() {
+		c.Info <- nil
+		return
+	}
+	c.Info <- conn.ConnInfo()
+}
+
 var (
-	CLOSE_CMD = &CloseCmd{}
+	CLOSE_CMD       = &CloseCmd{}
+	INFO_CMD        = &InfoCmd{}
+	INFO_UPDATE_CMD = &InfoUpdateCmd{}
 )
@@ -34,3 +34,77 @@ func (s *ClientCmdSuite) TestErrorCmd(c *C) {
 	cmd := &ErrorCmd{io.EOF}
 	cmd.Process(conn)
 }
+
+func (s *ClientCmdSuite) TestInfoCmd(c *C) {
+	ctrl := gomock.NewController(c)
+	defer ctrl.Finish()
+
+	info := []byte(`{"ldm":true}`)
+	server := NewMockServer(ctrl)
+	server.EXPECT().Info().Return(&info)
+
+	conn := NewMockConn(ctrl)
+	conn.EXPECT().Server().Return(server)
+	conn.EXPECT().AuthHelper().Return(NewAuthHelper(conn, &AuthConfig{}))
+	conn.EXPECT().Closed().Return(false)
+	conn.EXPECT().Write(NewResponse("INFO ", info))
+	INFO_CMD.Process(conn)
+
+	conn.EXPECT().Closed().Return(true)
+	INFO_CMD.Process(conn)
+}
+
+func (s *ClientCmdSuite) TestInfoUpdateCmd(c *C) {
+	ctrl := gomock.NewController(c)
+	defer ctrl.Finish()
+
+	info := []byte(`{"ldm":true}`)
+	server := NewMockServer(ctrl)
+	server.EXPECT().Info().Return(&info)
+
+	options := &ConnOptions{Protocol: PROTOCOL_DYNAMIC}
+	conn := NewMockConn(ctrl)
+	conn.EXPECT().Options().Return(options).AnyTimes()
+	conn.EXPECT().Server().Return(server)
+	conn.EXPECT().AuthHelper().Return(NewAuthHelper(conn, &AuthConfig{}))
+	conn.EXPECT().Closed().Return(false).Times(2)
+	conn.EXPECT().Write(NewResponse("INFO ", info))
+	INFO_UPDATE_CMD.Process(conn)
+
+	// Clients on the original protocol don't expect unsolicited INFO
+	options.Protocol = PROTOCOL_ORIGINAL
+	INFO_UPDATE_CMD.Process(conn)
+}
+
+func (s *ClientCmdSuite) TestReloadAuthCmd(c *C) {
+	ctrl := gomock.NewController(c)
+	defer ctrl.Finish()
+
+	conn := NewMockConn(ctrl)
+	conn.EXPECT().RemoteAddr().Return(&DummyAddr{}).AnyTimes()
+	helper := NewAuthHelper(conn, &AuthConfig{})
+	conn.EXPECT().AuthHelper().Return(helper).AnyTimes()
+	conn.EXPECT().Closed().Return(false).Times(2)
+
+	(&ReloadAuthCmd{&AuthConfig{}}).Process(conn)
+
+	conn.EXPECT().CloseWithError(ErrAuthRevoked)
+	(&ReloadAuthCmd{&AuthConfig{Users: map[string]string{"foo": "bar"}}}).Process(conn)
+}
+
+func (s *ClientCmdSuite) TestConnInfoCmd(c *C) {
+	ctrl := gomock.NewController(c)
+	defer ctrl.Finish()
+
+	info := &ConnInfo{Id: 7}
+	cmd := &ConnInfoCmd{make(chan *ConnInfo, 2)}
+	conn := NewMockConn(ctrl)
+	conn.EXPECT().Closed().Return(false)
+	conn.EXPECT().ConnInfo().Return(info)
+	cmd.Process(conn)
+	c.Check(<-cmd.Info, Equals, info)
+
+	conn.EXPECT().Closed().Return(true)
+	cmd.Process(conn)
+	c.Check(<-cmd.Info, IsNil)
+}
@@ -0,0 +1,187 @@
+// Copyright (c) 2012 VMware, Inc.
+
+package gonatsd
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync/atomic"
+)
+
+// Route information for connections to other servers in the cluster.
+type Route struct {
+	Address   string // Address we dialed, empty for inbound routes
+	Outbound  bool   // True iff this server dialed the route
+	ServerId  string // Remote server id, known once its INFO arrives
+	Duplicate bool   // True iff the route was dropped in favor of another one
+}
+
+// Map of all route request parsers.
+// Routes speak the client protocol, except that instead of PUB the remote
+// server sends MSG or HMSG addressed to the routed subscription id.
+var ROUTE_PARSERS = map[string]func(Conn, string) (Request, error){
+	MSG:     ParseRoutedMessageRequest,
+	HMSG:    ParseRoutedHeaderMessageRequest,
+	SUB:     ParseSubscriptionRequest,
+	UNSUB:   ParseUnsubscriptionRequest,
+	PING:    ParsePingRequest,
+	PONG:    ParsePongRequest,
+	CONNECT: ParseConnectRequest,
+	INFO:    ParseRouteInfoRequest,
+}
+
+// Cluster keeps track of the routes to other servers and the local
+// subscriptions that have been propagated to them.
+// It must only be used from the server loop.
+type Cluster struct {
+	serverId      string
+	enabled       bool
+	routes        map[string]Conn
+	routeCount    int64
+	subscriptions map[int]*Subscription
+	sids          map[*Subscription]int
+	nextSid       int
+}
+
+// Create a new Cluster for the server with the specified id.
+// A disabled cluster doesn't track any subscriptions.
+func NewCluster(serverId string, enabled bool) *Cluster {
+	c := &Cluster{serverId: serverId, enabled: enabled}
+	c.routes = make(map[string]Conn)
+	c.subscriptions = make(map[int]*Subscription)
+	c.sids = make(map[*Subscription]int)
+	return c
+}
+
+// Register a route once the remote server id is known. The route sends
+// the local subscriptions itself, see Interest.
+// Returns false iff the route points back to us or duplicates an existing
+// route. When two servers dial each other both keep the connection dialed
+// by the server with the lowest id, so the other dialer can stop retrying.
+func (c *Cluster) Register(conn Conn) bool {
+	route := conn.Route()
+	if route.ServerId == c.serverId {
+		route.Duplicate = true
+		return false
+	}
+
+	existing := c.routes[route.ServerId]
+	if existing == conn {
+		return true
+	}
+
+	if existing != nil {
+		preferred := c.serverId
+		if route.ServerId < preferred {
+			preferred = route.ServerId
+		}
+		if c.dialer(existing.Route()) == preferred || c.dialer(route) != preferred {
+			route.Duplicate = true
+			return false
+		}
+		existing.Route().Duplicate = true
+		go existing.ServeCommand(&CloseWithErrorCmd{ErrDuplicateRoute})
+	} else {
+		atomic.AddInt64(&c.routeCount, 1)
+	}
+
+	c.routes[route.ServerId] = conn
+	return true
+}
+
+// Unregister a closed route.
+func (c *Cluster) Unregister(conn Conn) {
+	serverId := conn.Route().ServerId
+	if c.routes[serverId] == conn {
+		delete(c.routes, serverId)
+		atomic.AddInt64(&c.routeCount, -1)
+	}
+}
+
+// Propagate a new local subscription to all routes.
+// Subscriptions owned by routes are never propagated to avoid loops,
+// which requires the cluster to be a full mesh. Neither are those of other
+// accounts than the global one, routes don't carry accounts.
+func (c *Cluster) Subscribed(subscription *Subscription) {
+	if !c.enabled || subscription.Conn.Route() != nil || !subscription.Account.Global() {
+		return
+	}
+
+	c.nextSid++
+	sid := c.nextSid
+	c.subscriptions[sid] = subscription
+	c.sids[subscription] = sid
+
+	c.broadcast(subscribeResponse(subscription, sid))
+}
+
+// Propagate the removal of a local subscription to all routes.
+func (c *Cluster) Unsubscribed(subscription *Subscription) {
+	sid, ok := c.sids[subscription]
+	if !ok {
+		return
+	}
+
+	delete(c.sids, subscription)
+	delete(c.subscriptions, sid)
+
+	c.broadcast(NewStringResponse(fmt.Sprintf("UNSUB %d", sid)))
+}
+
+// Returns the SUBs for all local subscriptions propagated to the routes,
+// for a newly registered route to send.
+func (c *Cluster) Interest() []*Response {
+	sids := make([]int, 0, len(c.subscriptions))
+	for sid, _ := range c.subscriptions {
+		sids = append(sids, sid)
+	}
+	sort.Ints(sids)
+
+	interest := make([]*Response, 0, len(sids))
+	for _, sid := range sids {
+		interest = append(interest, subscribeResponse(c.subscriptions[sid], sid))
+	}
+	return interest
+}
+
+// Returns the local subscription for the routed subscription id, or nil if
+// it's gone.
+func (c *Cluster) Subscription(sid int) *Subscription {
+	return c.subscriptions[sid]
+}
+
+// Queue the SUB or UNSUB on the routes like a message, so it's written from
+// their dispatch loop. Writing from the server loop would close slow routes
+// there, and closing waits on the server loop.
+func (c *Cluster) broadcast(response *Response) {
+	for _, route := range c.routes {
+		route.ServeMessage(&SubscribedMessage{Interest: response})
+	}
+}
+
+func (c *Cluster) dialer(route *Route) string {
+	if route.Outbound {
+		return c.serverId
+	}
+	return route.ServerId
+}
+
+func subscribeResponse(subscription *Subscription, sid int) *Response {
+	if subscription.Queue != nil {
+		return NewStringResponse(fmt.Sprintf("SUB %s %s %d", subscription.Subject, *subscription.Queue, sid))
+	}
+	return NewStringResponse(fmt.Sprintf("SUB %s %d", subscription.Subject, sid))
+}
+
+// Returns the CONNECT sent when dialing a route.
+func NewRouteConnectResponse(config *ClusterConfig) *Response {
+	off := false
+	request := &ConnectRequest{Verbose: &off, Pedantic: &off}
+	if len(config.User) > 0 {
+		request.User = &config.User
+		request.Password = &config.Password
+	}
+	payload, _ := json.Marshal(request)
+	return NewResponse("CONNECT ", payload)
+}
@@ -0,0 +1,308 @@
+// Copyright (c) 2012 VMware, Inc.
+
+package gonatsd_test
+
+import (
+	"code.google.com/p/gomock/gomock"
+	. "gonatsd/gonatsd"
+	. "gonatsd/gonatsd/mocks"
+	. "launchpad.net/gocheck"
+	"net"
+	"time"
+)
+
+type ClusterSuite struct{}
+
+var _ = Suite(&ClusterSuite{})
+
+var global = NewAccount(GLOBAL_ACCOUNT)
+
+func newMockRoute(ctrl *gomock.Controller, route *Route) *MockConn {
+	conn := NewMockConn(ctrl)
+	conn.EXPECT().Route().Return(route).AnyTimes()
+	return conn
+}
+
+func newMockClient(ctrl *gomock.Controller) *MockConn {
+	conn := NewMockConn(ctrl)
+	conn.EXPECT().Route().Return(nil).AnyTimes()
+	return conn
+}
+
+func (s *ClusterSuite) TestRegister(c *C) {
+	ctrl := gomock.NewController(c)
+	defer ctrl.Finish()
+
+	cluster := NewCluster("a", true)
+	route := newMockRoute(ctrl, &Route{ServerId: "b", Outbound: true})
+
+	c.Check(cluster.Register(route), Equals, true)
+	c.Check(cluster.Register(route), Equals, true)
+}
+
+func (s *ClusterSuite) TestRegisterSelf(c *C) {
+	ctrl := gomock.NewController(c)
+	defer ctrl.Finish()
+
+	cluster := NewCluster("a", true)
+	info := &Route{ServerId: "a", Outbound: true}
+	route := newMockRoute(ctrl, info)
+
+	c.Check(cluster.Register(route), Equals, false)
+	c.Check(info.Duplicate, Equals, true)
+}
+
+func (s *ClusterSuite) TestRegisterDuplicate(c *C) {
+	ctrl := gomock.NewController(c)
+	defer ctrl.Finish()
+
+	// We have the lowest id, so our outbound route wins.
+	cluster := NewCluster("a", true)
+	outbound := newMockRoute(ctrl, &Route{ServerId: "b", Outbound: true})
+	inboundInfo := &Route{ServerId: "b"}
+	inbound := newMockRoute(ctrl, inboundInfo)
+
+	c.Check(cluster.Register(outbound), Equals, true)
+	c.Check(cluster.Register(inbound), Equals, false)
+	c.Check(inboundInfo.Duplicate, Equals, true)
+}
+
+func (s *ClusterSuite) TestRegisterDuplicateReplaces(c *C) {
+	ctrl := gomock.NewController(c)
+	defer ctrl.Finish()
+
+	// The other server has the lowest id, so its route wins.
+	cluster := NewCluster("b", true)
+	outboundInfo := &Route{ServerId: "a", Outbound: true}
+	outbound := newMockRoute(ctrl, outboundInfo)
+	inbound := newMockRoute(ctrl, &Route{ServerId: "a"})
+
+	barrier := make(chan bool, 1)
+	outbound.EXPECT().ServeCommand(&CloseWithErrorCmd{ErrDuplicateRoute}).Do(func(ClientCmd) {
+		barrier <- true
+	})
+
+	c.Check(cluster.Register(outbound), Equals, true)
+	c.Check(cluster.Register(inbound), Equals, true)
+	c.Check(outboundInfo.Duplicate, Equals, true)
+
+	select {
+	case <-barrier:
+	case <-time.After(time.Second):
+		c.Errorf("Should have closed the redundant route")
+	}
+}
+
+func (s *ClusterSuite) TestSubscribed(c *C) {
+	ctrl := gomock.NewController(c)
+	defer ctrl.Finish()
+
+	cluster := NewCluster("a", true)
+	route := newMockRoute(ctrl, &Route{ServerId: "b", Outbound: true})
+	cluster.Register(route)
+
+	queue := "bar"
+	subscription := &Subscription{Subject: "foo", Queue: &queue, Conn: newMockClient(ctrl), Account: global}
+
+	route.EXPECT().ServeMessage(&SubscribedMessage{Interest: NewStringResponse("SUB foo bar 1")})
+	cluster.Subscribed(subscription)
+	c.Check(cluster.Subscription(1), Equals, subscription)
+
+	route.EXPECT().ServeMessage(&SubscribedMessage{Interest: NewStringResponse("UNSUB 1")})
+	cluster.Unsubscribed(subscription)
+	c.Check(cluster.Subscription(1), IsNil)
+
+	// Already gone
+	cluster.Unsubscribed(subscription)
+}
+
+func (s *ClusterSuite) TestInterest(c *C) {
+	ctrl := gomock.NewController(c)
+	defer ctrl.Finish()
+
+	queue := "baz"
+	cluster := NewCluster("a", true)
+	cluster.Subscribed(&Subscription{Subject: "foo", Conn: newMockClient(ctrl), Account: global})
+	cluster.Subscribed(&Subscription{Subject: "bar", Queue: &queue, Conn: newMockClient(ctrl), Account: global})
+
+	// Registering doesn't write to the route, it sends the interest itself
+	route := newMockRoute(ctrl, &Route{ServerId: "b", Outbound: true})
+	c.Check(cluster.Register(route), Equals, true)
+	c.Check(cluster.Interest(), DeepEquals, []*Response{NewStringResponse("SUB foo 1"),
+		NewStringResponse("SUB bar baz 2")})
+}
+
+func (s *ClusterSuite) TestRegisterRouteCmd(c *C) {
+	ctrl := gomock.NewController(c)
+	defer ctrl.Finish()
+
+	cluster := NewCluster("a", true)
+	cluster.Subscribed(&Subscription{Subject: "foo", Conn: newMockClient(ctrl), Account: global})
+	server := NewMockServer(ctrl)
+	server.EXPECT().Cluster().Return(cluster).AnyTimes()
+
+	cmd := &RegisterRouteCmd{Conn: newMockRoute(ctrl, &Route{ServerId: "b"}), Registered: make(chan bool, 1)}
+	cmd.Process(server)
+	c.Check(<-cmd.Registered, Equals, true)
+	c.Check(cmd.Interest, DeepEquals, []*Response{NewStringResponse("SUB foo 1")})
+
+	// No interest for routes that aren't kept
+	cmd = &RegisterRouteCmd{Conn: newMockRoute(ctrl, &Route{ServerId: "a"}), Registered: make(chan bool, 1)}
+	cmd.Process(server)
+	c.Check(<-cmd.Registered, Equals, false)
+	c.Check(cmd.Interest, IsNil)
+}
+
+func (s *ClusterSuite) TestSubscribedFromRoute(c *C) {
+	ctrl := gomock.NewController(c)
+	defer ctrl.Finish()
+
+	cluster := NewCluster("a", true)
+	route := newMockRoute(ctrl, &Route{ServerId: "b", Outbound: true})
+	cluster.Register(route)
+
+	other := newMockRoute(ctrl, &Route{ServerId: "c"})
+	cluster.Subscribed(&Subscription{Subject: "foo", Conn: other, Account: global})
+	c.Check(cluster.Subscription(1), IsNil)
+}
+
+func (s *ClusterSuite) TestSubscribedInAccount(c *C) {
+	ctrl := gomock.NewController(c)
+	defer ctrl.Finish()
+
+	cluster := NewCluster("a", true)
+	route := newMockRoute(ctrl, &Route{ServerId: "b", Outbound: true})
+	cluster.Register(route)
+
+	cluster.Subscribed(&Subscription{Subject: "foo", Conn: newMockClient(ctrl), Account: NewAccount("a")})
+	c.Check(cluster.Subscription(1), IsNil)
+}
+
+func (s *ClusterSuite) TestSubscribedDisabled(c *C) {
+	ctrl := gomock.NewController(c)
+	defer ctrl.Finish()
+
+	cluster := NewCluster("a", false)
+	cluster.Subscribed(&Subscription{Subject: "foo", Conn: newMockClient(ctrl), Account: global})
+	c.Check(cluster.Subscription(1), IsNil)
+}
+
+func (s *ClusterSuite) TestUnregister(c *C) {
+	ctrl := gomock.NewController(c)
+	defer ctrl.Finish()
+
+	cluster := NewCluster("a", true)
+	route := newMockRoute(ctrl, &Route{ServerId: "b", Outbound: true})
+	cluster.Register(route)
+	cluster.Unregister(route)
+
+	// No routes left to write to
+	cluster.Subscribed(&Subscription{Subject: "foo", Conn: newMockClient(ctrl), Account: global})
+}
+
+func (s *ClusterSuite) TestRoutedMessageParse(c *C) {
+	ctrl := gomock.NewController(c)
+	defer ctrl.Finish()
+
+	config := &Config{}
+	config.Limits.Payload = 100
+	server := NewMockServer(ctrl)
+	server.EXPECT().Config().Return(config).AnyTimes()
+	conn := NewMockConn(ctrl)
+	conn.EXPECT().Server().Return(server).AnyTimes()
+	conn.EXPECT().Read(gomock.Any()).Return(100, nil).Do(func(buf []byte) {
+		copy(buf, []byte("TEST"))
+	}).Times(2)
+	conn.EXPECT().ReadControlLine().Times(2)
+
+	req, err := ParseRoutedMessageRequest(conn, "FOO 7 4")
+	c.Check(err, IsNil)
+	c.Check(req, DeepEquals, &RoutedMessageRequest{7,
+		&Message{Subject: "FOO", Content: []byte("TEST")}})
+
+	req, err = ParseRoutedMessageRequest(conn, "FOO 7 inbox 4")
+	c.Check(err, IsNil)
+	c.Check(req, DeepEquals, &RoutedMessageRequest{7,
+		&Message{Subject: "FOO", ReplyTo: "inbox", Content: []byte("TEST")}})
+}
+
+// Served with SendServerCmd, which keeps delivering to the route while the
+// server loop is busy, or both sides could wait on each other.
+func (s *ClusterSuite) TestRoutedMessageServe(c *C) {
+	ctrl := gomock.NewController(c)
+	defer ctrl.Finish()
+
+	message := &Message{Subject: "FOO", Content: []byte("TEST")}
+	conn := NewMockConn(ctrl)
+	conn.EXPECT().SendServerCmd(&RoutedMessageCmd{7, message})
+
+	c.Check((&RoutedMessageRequest{7, message}).Serve(conn), IsNil)
+}
+
+func (s *ClusterSuite) TestRoutedMessageParseBadSid(c *C) {
+	ctrl := gomock.NewController(c)
+	defer ctrl.Finish()
+
+	conn := NewMockConn(ctrl)
+	req, err := ParseRoutedMessageRequest(conn, "FOO bar 4")
+	c.Check(err, Equals, ErrUnknownOp)
+	c.Check(req, IsNil)
+}
+
+func (s *ClusterSuite) TestRoutedMessageCmd(c *C) {
+	ctrl := gomock.NewController(c)
+	defer ctrl.Finish()
+
+	cluster := NewCluster("a", true)
+	subscription := &Subscription{Subject: "foo", Conn: newMockClient(ctrl), Account: global}
+	cluster.Subscribed(subscription)
+
+	message := &Message{Subject: "foo", Content: []byte("TEST")}
+	server := NewMockServer(ctrl)
+	server.EXPECT().Cluster().Return(cluster).AnyTimes()
+	server.EXPECT().Stats().Return(NewStats()).AnyTimes()
+	server.EXPECT().DeliverMessage(subscription, message)
+
+	(&RoutedMessageCmd{1, message}).Process(server)
+
+	// Unknown subscriptions are dropped
+	(&RoutedMessageCmd{2, message}).Process(server)
+
+	// So are messages with headers for subscriptions without header support
+	header, _ := ParseHeader([]byte("NATS/1.0\r\n\r\n"))
+	(&RoutedMessageCmd{1, &Message{Subject: "foo", Header: header}}).Process(server)
+}
+
+func (s *ClusterSuite) TestRouteInfoParse(c *C) {
+	ctrl := gomock.NewController(c)
+	defer ctrl.Finish()
+
+	conn := NewMockConn(ctrl)
+	req, err := ParseRouteInfoRequest(conn, `{"server_id":"b"}`)
+	c.Check(err, IsNil)
+	c.Check(req.(*RouteInfoRequest).Info.ServerId, Equals, "b")
+
+	req, err = ParseRouteInfoRequest(conn, `{}`)
+	c.Check(err, Equals, ErrInvalidRouteInfo)
+	c.Check(req, IsNil)
+}
+
+func (s *ClusterSuite) TestRouteInfoServe(c *C) {
+	ctrl := gomock.NewController(c)
+	defer ctrl.Finish()
+
+	route := &Route{Outbound: true}
+	conn := newMockRoute(ctrl, route)
+	conn.EXPECT().Options().Return(&ConnOptions{}).AnyTimes()
+	conn.EXPECT().RemoteAddr().Return(&net.TCPAddr{}).AnyTimes()
+	conn.EXPECT().SendServerCmd(gomock.Any()).Do(func(cmd ServerCmd) {
+		register := cmd.(*RegisterRouteCmd)
+		register.Interest = []*Response{NewStringResponse("SUB foo 1")}
+		register.Registered <- true
+	})
+	conn.EXPECT().Write(NewStringResponse("SUB foo 1"))
+
+	req := &RouteInfoRequest{&Info{ServerId: "b"}}
+	c.Check(req.Serve(conn), IsNil)
+	c.Check(route.ServerId, Equals, "b")
+}
@@ -3,10 +3,13 @@
 package gonatsd
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"launchpad.net/goyaml"
+	"net/url"
+	"reflect"
 	"time"
 )
 
@@ -14,6 +17,12 @@ const (
 	DEFAULT_MAX_CONTROL = 1024
 	DEFAULT_MAX_PAYLOAD = 1024 * 1024
 	DEFAULT_MAX_PENDING = 10 * 1024 * 1024
+
+	DEFAULT_ROUTE_RECONNECT = 1 * time.Second
+	DEFAULT_TLS_TIMEOUT     = 2 * time.Second
+
+	DEFAULT_SHUTDOWN_TIMEOUT = 10 * time.Second
+	DEFAULT_LAME_DUCK_WINDOW = 30 * time.Second
 )
 
 type PingConfig struct {
@@ -31,32 +40,162 @@ type VarzConfig struct {
 	Users       map[string]string `yaml:"users"`
 }
 
+type MetricsPushConfig struct {
+	Protocol         string `yaml:"protocol"` // statsd or graphite
+	Address          string `yaml:"address"`
+	Prefix           string `yaml:"prefix"`
+	Interval         string `yaml:"interval"`
+	IntervalDuration time.Duration
+}
+
+type MetricsConfig struct {
+	Push MetricsPushConfig `yaml:"push"`
+}
+
+type SubjectPermissionsConfig struct {
+	Allow []string `yaml:"allow"`
+	Deny  []string `yaml:"deny"`
+}
+
+type PermissionsConfig struct {
+	Publish   SubjectPermissionsConfig `yaml:"publish"`
+	Subscribe SubjectPermissionsConfig `yaml:"subscribe"`
+}
+
+type CalloutConfig struct {
+	URL              string `yaml:"url"`
+	Timeout          string `yaml:"timeout"`
+	TimeoutDuration  time.Duration
+	CacheTTL         string `yaml:"cache_ttl"`
+	CacheTTLDuration time.Duration
+	Client           *AuthCallout
+}
+
 type AuthConfig struct {
-	Users           map[string]string `yaml:"users"`
-	Timeout         string            `yaml:"timeout"`
+	Users           map[string]string            `yaml:"users"`
+	Certificates    map[string]string            `yaml:"certificates"` // certificate CN or SAN -> user
+	Tokens          []string                     `yaml:"tokens"`
+	PublicKeys      []string                     `yaml:"public_keys"` // base64 URL encoded ed25519 keys
+	Permissions     map[string]PermissionsConfig `yaml:"permissions"` // user -> permissions
+	UserPermissions map[string]*Permissions
+	UserAccounts    map[string]string
+	Callout         CalloutConfig `yaml:"callout"`
+	Timeout         string        `yaml:"timeout"`
 	TimeoutDuration time.Duration
 }
 
+// Returns true iff clients have to authenticate.
+func (c *AuthConfig) Required() bool {
+	return len(c.Users) > 0 || len(c.Certificates) > 0 || len(c.Tokens) > 0 || len(c.PublicKeys) > 0 ||
+		c.Callout.Client != nil
+}
+
+// Returns the methods clients can authenticate with.
+func (c *AuthConfig) Methods() []string {
+	methods := make([]string, 0, 5)
+	if len(c.Users) > 0 {
+		methods = append(methods, AUTH_USER)
+	}
+	if len(c.Tokens) > 0 {
+		methods = append(methods, AUTH_TOKEN)
+	}
+	if len(c.Certificates) > 0 {
+		methods = append(methods, AUTH_CERTIFICATE)
+	}
+	if len(c.PublicKeys) > 0 {
+		methods = append(methods, AUTH_PUBLIC_KEY)
+	}
+	if c.Callout.Client != nil {
+		methods = append(methods, AUTH_CALLOUT)
+	}
+	return methods
+}
+
+type ImportConfig struct {
+	Account string `yaml:"account"`
+	Subject string `yaml:"subject"`
+}
+
+type AccountConfig struct {
+	Users   []string       `yaml:"users"`
+	Exports []string       `yaml:"exports"`
+	Imports []ImportConfig `yaml:"imports"`
+}
+
 type LogConfig struct {
 	MinLevel string `yaml:"level"`
 	Out      string `yaml:"file"`
 }
 
+type PublishLimitsConfig struct {
+	Messages int `yaml:"msgs_per_sec" json:"msgs_per_sec"`
+	Bytes    int `yaml:"bytes_per_sec" json:"bytes_per_sec"`
+}
+
 type LimitsConfig struct {
-	Payload     int `yaml:"payload"`
-	Pending     int `yaml:"pending"`
-	ControlLine int `yaml:"control"`
-	Connections int `yaml:"connections"`
+	Payload         int                            `yaml:"payload" json:"payload"`
+	Pending         int                            `yaml:"pending" json:"pending"`
+	ControlLine     int                            `yaml:"control" json:"control"`
+	Connections     int                            `yaml:"connections" json:"connections"`
+	UserConnections int                            `yaml:"user_connections" json:"user_connections"` // per authenticated user
+	IPConnections   int                            `yaml:"ip_connections" json:"ip_connections"`     // per remote address
+	Subscriptions   int                            `yaml:"subscriptions" json:"subscriptions"`       // per connection
+	SubjectLength   int                            `yaml:"subject_length" json:"subject_length"`
+	SubjectTokens   int                            `yaml:"subject_tokens" json:"subject_tokens"`
+	Publish         PublishLimitsConfig            `yaml:"publish" json:"publish"`
+	PublishUsers    map[string]PublishLimitsConfig `yaml:"publish_users" json:"publish_users"` // user -> publish limits
+	PublishAction   string                         `yaml:"publish_action" json:"publish_action"`
+}
+
+// Returns the publish limits of the user.
+func (c *LimitsConfig) PublishLimits(user string) *PublishLimitsConfig {
+	if limits, ok := c.PublishUsers[user]; ok {
+		return &limits
+	}
+	return &c.Publish
+}
+
+type ClusterConfig struct {
+	BindAddress       string   `yaml:"bind_address"`
+	Routes            []string `yaml:"routes"`
+	User              string   `yaml:"user"`
+	Password          string   `yaml:"password"`
+	Reconnect         string   `yaml:"reconnect"`
+	ReconnectDuration time.Duration
+}
+
+type TLSConfig struct {
+	Cert            string   `yaml:"cert"`
+	Key             string   `yaml:"key"`
+	CA              string   `yaml:"ca"`
+	MinVersion      string   `yaml:"min_version"`
+	Ciphers         []string `yaml:"ciphers"`
+	Verify          bool     `yaml:"verify"`
+	Timeout         string   `yaml:"timeout"`
+	TimeoutDuration time.Duration
+	ServerConfig    *tls.Config
+}
+
+type ShutdownConfig struct {
+	Timeout          string `yaml:"timeout"`
+	TimeoutDuration  time.Duration
+	LameDuck         string `yaml:"lame_duck"`
+	LameDuckDuration time.Duration
 }
 
 type Config struct {
-	BindAddress string        `yaml:"bind_address"`
-	Ping        PingConfig    `yaml:"ping"`
-	Profile     ProfileConfig `yaml:"pprof"`
-	Varz        VarzConfig    `yaml:"varz"`
-	Auth        AuthConfig    `yaml:"auth"`
-	Log         LogConfig     `yaml:"logging"`
-	Limits      LimitsConfig  `yaml:"limits"`
+	BindAddress string                   `yaml:"bind_address"`
+	Ping        PingConfig               `yaml:"ping"`
+	Profile     ProfileConfig            `yaml:"pprof"`
+	Varz        VarzConfig               `yaml:"varz"`
+	Metrics     MetricsConfig            `yaml:"metrics"`
+	Auth        AuthConfig               `yaml:"auth"`
+	Accounts    map[string]AccountConfig `yaml:"accounts"`
+	Log         LogConfig                `yaml:"logging"`
+	Limits      LimitsConfig             `yaml:"limits"`
+	Cluster     ClusterConfig            `yaml:"cluster"`
+	TLS         TLSConfig                `yaml:"tls"`
+	Shutdown    ShutdownConfig           `yaml:"shutdown"`
 }
 
 // Parse the server configuration.
@@ -76,6 +215,26 @@ func ParseConfig(filename string) (*Config, error) {
 		return nil, errors.New("bind_address is required")
 	}
 
+	if len(config.Metrics.Push.Address) > 0 {
+		push := &config.Metrics.Push
+		if push.Protocol != PUSH_STATSD && push.Protocol != PUSH_GRAPHITE {
+			return nil, fmt.Errorf("invalid metrics push protocol '%s'", push.Protocol)
+		}
+
+		if len(push.Interval) > 0 {
+			push.IntervalDuration, err = time.ParseDuration(push.Interval)
+			if err != nil || push.IntervalDuration <= 0 {
+				return nil, fmt.Errorf("invalid metrics push interval '%s'", push.Interval)
+			}
+		} else {
+			push.IntervalDuration = DEFAULT_PUSH_INTERVAL
+		}
+
+		if len(push.Prefix) == 0 {
+			push.Prefix = DEFAULT_PUSH_PREFIX
+		}
+	}
+
 	if len(config.Auth.Timeout) > 0 {
 		config.Auth.TimeoutDuration, err = time.ParseDuration(config.Auth.Timeout)
 		if err != nil {
@@ -83,6 +242,91 @@ func ParseConfig(filename string) (*Config, error) {
 		}
 	}
 
+	for user, password := range config.Auth.Users {
+		err = checkPasswordHash(password)
+		if err != nil {
+			return nil, fmt.Errorf("invalid password hash for '%s': %s", user, err.Error())
+		}
+	}
+
+	for _, token := range config.Auth.Tokens {
+		err = checkPasswordHash(token)
+		if err != nil {
+			return nil, fmt.Errorf("invalid token hash: %s", err.Error())
+		}
+	}
+
+	for _, publicKey := range config.Auth.PublicKeys {
+		_, err = DecodePublicKey(publicKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid public key '%s': %s", publicKey, err.Error())
+		}
+	}
+
+	for user, password := range config.Varz.Users {
+		err = checkPasswordHash(password)
+		if err != nil {
+			return nil, fmt.Errorf("invalid varz password hash for '%s': %s", user, err.Error())
+		}
+	}
+
+	if len(config.Auth.Permissions) > 0 {
+		config.Auth.UserPermissions = make(map[string]*Permissions)
+		for user, permissionsConfig := range config.Auth.Permissions {
+			config.Auth.UserPermissions[user], err = NewPermissions(&permissionsConfig)
+			if err != nil {
+				return nil, fmt.Errorf("invalid permissions for '%s': %s", user, err.Error())
+			}
+		}
+	}
+
+	if len(config.Auth.Callout.URL) > 0 {
+		endpoint, err := url.Parse(config.Auth.Callout.URL)
+		if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") {
+			return nil, fmt.Errorf("invalid auth callout url '%s'", config.Auth.Callout.URL)
+		}
+
+		if len(config.Auth.Callout.Timeout) > 0 {
+			config.Auth.Callout.TimeoutDuration, err = time.ParseDuration(config.Auth.Callout.Timeout)
+			if err != nil {
+				return nil, fmt.Errorf("invalid auth callout timeout '%s': %s", config.Auth.Callout.Timeout,
+					err.Error())
+			}
+		} else {
+			config.Auth.Callout.TimeoutDuration = DEFAULT_CALLOUT_TIMEOUT
+		}
+
+		if len(config.Auth.Callout.CacheTTL) > 0 {
+			config.Auth.Callout.CacheTTLDuration, err = time.ParseDuration(config.Auth.Callout.CacheTTL)
+			if err != nil {
+				return nil, fmt.Errorf("invalid auth callout cache ttl '%s': %s", config.Auth.Callout.CacheTTL,
+					err.Error())
+			}
+		} else {
+			config.Auth.Callout.CacheTTLDuration = DEFAULT_CALLOUT_CACHE_TTL
+		}
+
+		config.Auth.Callout.Client = NewAuthCallout(config.Auth.Callout.URL,
+			config.Auth.Callout.TimeoutDuration, config.Auth.Callout.CacheTTLDuration)
+	}
+
+	if len(config.Accounts) > 0 {
+		_, err = NewAccounts(config.Accounts)
+		if err != nil {
+			return nil, fmt.Errorf("invalid accounts: %s", err.Error())
+		}
+
+		config.Auth.UserAccounts = make(map[string]string)
+		for name, account := range config.Accounts {
+			for _, user := range account.Users {
+				if existing, ok := config.Auth.UserAccounts[user]; ok {
+					return nil, fmt.Errorf("user '%s' belongs to accounts '%s' and '%s'", user, existing, name)
+				}
+				config.Auth.UserAccounts[user] = name
+			}
+		}
+	}
+
 	if len(config.Ping.Interval) > 0 {
 		config.Ping.IntervalDuration, err = time.ParseDuration(config.Ping.Interval)
 		if err != nil {
@@ -90,6 +334,72 @@ func ParseConfig(filename string) (*Config, error) {
 		}
 	}
 
+	if len(config.Cluster.Reconnect) > 0 {
+		config.Cluster.ReconnectDuration, err = time.ParseDuration(config.Cluster.Reconnect)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cluster reconnect interval '%s': %s", config.Cluster.Reconnect,
+				err.Error())
+		}
+	} else {
+		config.Cluster.ReconnectDuration = DEFAULT_ROUTE_RECONNECT
+	}
+
+	if len(config.TLS.Cert) > 0 || len(config.TLS.Key) > 0 {
+		config.TLS.ServerConfig, err = NewTLSConfig(&config.TLS)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tls config: %s", err.Error())
+		}
+
+		if len(config.TLS.Timeout) > 0 {
+			config.TLS.TimeoutDuration, err = time.ParseDuration(config.TLS.Timeout)
+			if err != nil {
+				return nil, fmt.Errorf("invalid tls timeout '%s': %s", config.TLS.Timeout, err.Error())
+			}
+		} else {
+			config.TLS.TimeoutDuration = DEFAULT_TLS_TIMEOUT
+		}
+	}
+
+	if len(config.Auth.Certificates) > 0 && (config.TLS.ServerConfig == nil || len(config.TLS.CA) == 0) {
+		return nil, errors.New("auth certificates require tls with a ca")
+	}
+
+	if len(config.Shutdown.Timeout) > 0 {
+		config.Shutdown.TimeoutDuration, err = time.ParseDuration(config.Shutdown.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid shutdown timeout '%s': %s", config.Shutdown.Timeout, err.Error())
+		}
+	} else {
+		config.Shutdown.TimeoutDuration = DEFAULT_SHUTDOWN_TIMEOUT
+	}
+
+	if len(config.Shutdown.LameDuck) > 0 {
+		config.Shutdown.LameDuckDuration, err = time.ParseDuration(config.Shutdown.LameDuck)
+		if err != nil {
+			return nil, fmt.Errorf("invalid lame duck window '%s': %s", config.Shutdown.LameDuck, err.Error())
+		}
+	} else {
+		config.Shutdown.LameDuckDuration = DEFAULT_LAME_DUCK_WINDOW
+	}
+
+	if config.Limits.Publish.Messages < 0 || config.Limits.Publish.Bytes < 0 {
+		return nil, errors.New("invalid publish limits: must not be negative")
+	}
+
+	for user, limits := range config.Limits.PublishUsers {
+		if limits.Messages < 0 || limits.Bytes < 0 {
+			return nil, fmt.Errorf("invalid publish limits for '%s': must not be negative", user)
+		}
+	}
+
+	switch config.Limits.PublishAction {
+	case "":
+		config.Limits.PublishAction = PUBLISH_THROTTLE
+	case PUBLISH_THROTTLE, PUBLISH_ERROR:
+	default:
+		return nil, fmt.Errorf("invalid publish action '%s'", config.Limits.PublishAction)
+	}
+
 	if config.Limits.ControlLine == 0 {
 		config.Limits.ControlLine = DEFAULT_MAX_CONTROL
 	}
@@ -104,3 +414,71 @@ func ParseConfig(filename string) (*Config, error) {
 
 	return config, nil
 }
+
+// Returns the configuration to apply when reloading the next configuration
+// at runtime, along with the names of the changed options that require a
+// restart. Those keep their current values.
+func (c *Config) Reload(next *Config) (*Config, []string) {
+	reloaded := *next
+	ignored := make([]string, 0)
+
+	if reloaded.BindAddress != c.BindAddress {
+		ignored = append(ignored, "bind_address")
+		reloaded.BindAddress = c.BindAddress
+	}
+
+	if !reflect.DeepEqual(reloaded.Profile, c.Profile) {
+		ignored = append(ignored, "pprof")
+		reloaded.Profile = c.Profile
+	}
+
+	if !reflect.DeepEqual(reloaded.Varz, c.Varz) {
+		ignored = append(ignored, "varz")
+		reloaded.Varz = c.Varz
+	}
+
+	if !reflect.DeepEqual(reloaded.Metrics, c.Metrics) {
+		ignored = append(ignored, "metrics")
+		reloaded.Metrics = c.Metrics
+	}
+
+	if !reflect.DeepEqual(reloaded.Cluster, c.Cluster) {
+		ignored = append(ignored, "cluster")
+		reloaded.Cluster = c.Cluster
+	}
+
+	// The parsed tls.Config is never equal, compare what it was created from.
+	tlsConfig, nextTLSConfig := c.TLS, reloaded.TLS
+	tlsConfig.ServerConfig, nextTLSConfig.ServerConfig = nil, nil
+	if !reflect.DeepEqual(nextTLSConfig, tlsConfig) {
+		ignored = append(ignored, "tls")
+	}
+	reloaded.TLS = c.TLS
+
+	// Keep the callout client, and its cache, unless the endpoint changed.
+	callout, nextCallout := c.Auth.Callout, reloaded.Auth.Callout
+	callout.Client, nextCallout.Client = nil, nil
+	if nextCallout == callout {
+		reloaded.Auth.Callout.Client = c.Auth.Callout.Client
+	}
+
+	// Accounts own the subscriptions, so users can't move between them.
+	if !reflect.DeepEqual(reloaded.Accounts, c.Accounts) {
+		ignored = append(ignored, "accounts")
+		reloaded.Accounts = c.Accounts
+	}
+	reloaded.Auth.UserAccounts = c.Auth.UserAccounts
+
+	if reloaded.Log.Out != c.Log.Out {
+		ignored = append(ignored, "logging.file")
+		reloaded.Log.Out = c.Log.Out
+	}
+
+	// Certificate auth depends on the TLS config that is kept.
+	if len(reloaded.Auth.Certificates) > 0 && (reloaded.TLS.ServerConfig == nil || len(reloaded.TLS.CA) == 0) {
+		ignored = append(ignored, "auth.certificates")
+		reloaded.Auth.Certificates = c.Auth.Certificates
+	}
+
+	return &reloaded, ignored
+}
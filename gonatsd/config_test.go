@@ -0,0 +1,96 @@
+// Copyright (c) 2012 VMware, Inc.
+
+package gonatsd_test
+
+import (
+	"crypto/tls"
+	. "gonatsd/gonatsd"
+	. "launchpad.net/gocheck"
+	"time"
+)
+
+type ConfigSuite struct{}
+
+var _ = Suite(&ConfigSuite{})
+
+func (s *ConfigSuite) TestReload(c *C) {
+	config := &Config{BindAddress: "0.0.0.0:4222"}
+	config.TLS.Cert = "server.crt"
+	config.TLS.ServerConfig = &tls.Config{}
+	config.Log.MinLevel = "info"
+
+	next := &Config{BindAddress: "0.0.0.0:4222"}
+	next.TLS.Cert = "server.crt"
+	next.TLS.ServerConfig = &tls.Config{}
+	next.Auth.Users = map[string]string{"foo": "bar"}
+	next.Limits.Payload = 1024
+	next.Log.MinLevel = "debug"
+
+	reloaded, ignored := config.Reload(next)
+	c.Check(ignored, HasLen, 0)
+	c.Check(reloaded.Auth.Users, DeepEquals, next.Auth.Users)
+	c.Check(reloaded.Limits.Payload, Equals, 1024)
+	c.Check(reloaded.Log.MinLevel, Equals, "debug")
+	c.Check(reloaded.TLS.ServerConfig, Equals, config.TLS.ServerConfig)
+}
+
+func (s *ConfigSuite) TestReloadIgnored(c *C) {
+	config := &Config{BindAddress: "0.0.0.0:4222"}
+	config.Cluster.Routes = []string{"10.0.0.1:4223"}
+
+	next := &Config{BindAddress: "0.0.0.0:4333"}
+	next.Cluster.Routes = []string{"10.0.0.2:4223"}
+	next.TLS.Cert = "server.crt"
+	next.Log.Out = "gonatsd.log"
+	next.Auth.Certificates = map[string]string{"svc.example.com": "svc"}
+	next.Limits.Pending = 1024
+	next.Metrics.Push.Address = "127.0.0.1:8125"
+	next.Accounts = map[string]AccountConfig{"a": AccountConfig{Users: []string{"foo"}}}
+	next.Auth.UserAccounts = map[string]string{"foo": "a"}
+
+	reloaded, ignored := config.Reload(next)
+	c.Check(ignored, DeepEquals, []string{"bind_address", "metrics", "cluster", "tls", "accounts", "logging.file",
+		"auth.certificates"})
+	c.Check(reloaded.BindAddress, Equals, "0.0.0.0:4222")
+	c.Check(reloaded.Cluster.Routes, DeepEquals, []string{"10.0.0.1:4223"})
+	c.Check(reloaded.TLS.Cert, Equals, "")
+	c.Check(reloaded.Log.Out, Equals, "")
+	c.Check(reloaded.Auth.Certificates, IsNil)
+	c.Check(reloaded.Accounts, IsNil)
+	c.Check(reloaded.Metrics.Push.Address, Equals, "")
+	c.Check(reloaded.Auth.UserAccounts, IsNil)
+	c.Check(reloaded.Limits.Pending, Equals, 1024)
+}
+
+func (s *ConfigSuite) TestReloadCallout(c *C) {
+	config := &Config{}
+	config.Auth.Callout = CalloutConfig{URL: "http://auth", TimeoutDuration: time.Second}
+	config.Auth.Callout.Client = NewAuthCallout("http://auth", time.Second, 0)
+
+	next := &Config{}
+	next.Auth.Callout = CalloutConfig{URL: "http://auth", TimeoutDuration: time.Second}
+	next.Auth.Callout.Client = NewAuthCallout("http://auth", time.Second, 0)
+
+	reloaded, _ := config.Reload(next)
+	c.Check(reloaded.Auth.Callout.Client, Equals, config.Auth.Callout.Client)
+
+	next.Auth.Callout.TimeoutDuration = 2 * time.Second
+	next.Auth.Callout.Client = NewAuthCallout("http://auth", 2*time.Second, 0)
+
+	reloaded, _ = config.Reload(next)
+	c.Check(reloaded.Auth.Callout.Client, Equals, next.Auth.Callout.Client)
+}
+
+func (s *ConfigSuite) TestAuthMethods(c *C) {
+	auth := &AuthConfig{}
+	c.Check(auth.Required(), Equals, false)
+	c.Check(auth.Methods(), HasLen, 0)
+
+	auth.Tokens = []string{"secret"}
+	c.Check(auth.Required(), Equals, true)
+	c.Check(auth.Methods(), DeepEquals, []string{"token"})
+
+	auth.Users = map[string]string{"foo": "bar"}
+	auth.Certificates = map[string]string{"svc.example.com": "svc"}
+	c.Check(auth.Methods(), DeepEquals, []string{"user", "token", "certificate"})
+}
@@ -4,6 +4,7 @@ package gonatsd
 
 import (
 	"bufio"
+	"crypto/x509"
 	"fmt"
 	"io"
 	"net"
@@ -14,10 +15,28 @@ import (
 )
 
 type ConnOptions struct {
-	Verbose  bool
-	Pedantic bool
+	Verbose      bool `json:"verbose"`
+	Pedantic     bool `json:"pedantic"`
+	Headers      bool `json:"headers"`       // messages with headers can be delivered
+	NoResponders bool `json:"no_responders"` // requests reaching no one get a status message
+	Echo         bool `json:"echo"`          // messages are delivered to their publisher
+	Protocol     int  `json:"protocol"`
 }
 
+// Client library and application, as sent in CONNECT.
+type ClientInfo struct {
+	Name    string `json:"name,omitempty"`
+	Lang    string `json:"lang,omitempty"`
+	Version string `json:"version,omitempty"`
+}
+
+// Client protocol versions.
+const (
+	PROTOCOL_ORIGINAL = 0
+	PROTOCOL_DYNAMIC  = 1 // the client understands INFO updates
+	MAX_PROTOCOL      = PROTOCOL_DYNAMIC
+)
+
 // Client connection.
 type Conn interface {
 	// Serve a subscribed message on the dispatch loop.
@@ -29,6 +48,10 @@ type Conn interface {
 	// Serve a client command on the dispatch loop.
 	ServeCommand(ClientCmd)
 
+	// Serve a client command on the dispatch loop unless its backlog is full.
+	// Returns false iff the command was dropped because of that.
+	TryServeCommand(ClientCmd) bool
+
 	// Read from the client.
 	Read([]byte) (int, error)
 
@@ -62,11 +85,36 @@ type Conn interface {
 	// Return the connection heartbeat helper.
 	HeartbeatHelper() HeartbeatHelper
 
+	// Return the connection auth helper.
+	AuthHelper() *AuthHelper
+
+	// Return the account the connection publishes and subscribes in.
+	Account() *Account
+
 	// Returns the connection options.
 	Options() *ConnOptions
 
+	// Returns the client library and application.
+	Client() *ClientInfo
+
+	// Returns the connection id, unique within the server.
+	Id() uint64
+
+	// Returns a snapshot of the connection.
+	// Must be called from the dispatch loop.
+	ConnInfo() *ConnInfo
+
 	// Returns the client remote address.
 	RemoteAddr() net.Addr
+
+	// Returns the verified TLS client certificates, if any.
+	PeerCertificates() []*x509.Certificate
+
+	// Returns the route information, nil for client connections.
+	Route() *Route
+
+	// Returns the number of bytes waiting to be written to the client.
+	Pending() int
 }
 
 // TCP connection interface for testing.
@@ -84,6 +132,7 @@ type conn struct {
 	started            bool
 	closed             bool
 	options            *ConnOptions
+	client             *ClientInfo
 	outboxQueue        *BoundedQueue
 	tc                 TCPConn
 	reader             *bufio.Reader
@@ -92,6 +141,17 @@ type conn struct {
 	authHelper         *AuthHelper
 	fatalError         chan *NATSError
 	writerDone         chan bool
+	done               chan bool
+	parsers            map[string]func(Conn, string) (Request, error)
+	route              *Route
+	rateLimiter        *RateLimiter
+	rateLimiterReady   bool
+	id                 uint64
+	start              time.Time
+	inMsgs             int64
+	inBytes            int64
+	outMsgs            int64
+	outBytes           int64
 }
 
 const (
@@ -102,6 +162,9 @@ const (
 	PING    = "PING"
 	PONG    = "PONG"
 	CONNECT = "CONNECT"
+	MSG     = "MSG"
+	HPUB    = "HPUB"
+	HMSG    = "HMSG"
 )
 
 const (
@@ -113,12 +176,43 @@ var (
 	// not a const so we can change it for testing
 	BUF_IO_SIZE = 64 * 1024
 
-	REQUESTS = []string{INFO, PUB, SUB, UNSUB, PING, PONG, CONNECT}
+	lastConnId uint64
+
+	REQUESTS = []string{INFO, PUB, HPUB, SUB, UNSUB, PING, PONG, CONNECT, MSG, HMSG}
 )
 
 // Creates a new connection given a server and an underlying TCP connection.
 func NewConn(server Server, tc TCPConn) Conn {
+	return newConn(server, tc, &server.Config().Auth)
+}
+
+// Creates a new route connection to another server in the cluster.
+// Outbound routes authenticate with the cluster credentials, inbound routes
+// require them if configured.
+func NewRouteConn(server Server, tc TCPConn, route *Route) Conn {
+	cluster := server.Config().Cluster
+	auth := &AuthConfig{Users: make(map[string]string)}
+	if !route.Outbound && len(cluster.User) > 0 {
+		auth.Users[cluster.User] = cluster.Password
+		auth.TimeoutDuration = server.Config().Auth.TimeoutDuration
+	}
+
+	c := newConn(server, tc, auth)
+	c.route = route
+	c.parsers = ROUTE_PARSERS
+	c.options.Verbose = false
+	c.options.Pedantic = false
+
+	if route.Outbound {
+		c.Write(NewRouteConnectResponse(&cluster))
+	}
+	return c
+}
+
+func newConn(server Server, tc TCPConn, auth *AuthConfig) *conn {
 	c := &conn{}
+	c.id = atomic.AddUint64(&lastConnId, 1)
+	c.start = time.Now().UTC()
 	c.inbox = make(chan Request, MAX_CONN_CHAN_BACKLOG)
 	c.outboxQueue = NewBoundedQueue(int32(server.Config().Limits.Pending))
 	c.commands = make(chan ClientCmd, MAX_CONN_CHAN_BACKLOG)
@@ -126,7 +220,9 @@ func NewConn(server Server, tc TCPConn) Conn {
 
 	c.server = server
 	c.subcriptions = make(map[int]*Subscription)
-	c.options = &ConnOptions{Pedantic: true, Verbose: true}
+	c.options = &ConnOptions{Pedantic: true, Verbose: true, Echo: true}
+	c.client = &ClientInfo{}
+	c.parsers = REQUEST_PARSERS
 
 	c.tc = tc
 	c.reader = bufio.NewReaderSize(tc, BUF_IO_SIZE)
@@ -134,11 +230,11 @@ func NewConn(server Server, tc TCPConn) Conn {
 
 	c.fatalError = make(chan *NATSError, 1)
 	c.writerDone = make(chan bool, 1)
+	c.done = make(chan bool)
 
 	c.heartbeatHelper = NewHeartbeatHelper(c, server.Config().Ping.IntervalDuration,
 		server.Config().Ping.MaxOutstanding)
-	c.authHelper = NewAuthHelper(c, server.Config().Auth.Users,
-		server.Config().Auth.TimeoutDuration)
+	c.authHelper = NewAuthHelper(c, auth)
 	return c
 }
 
@@ -153,8 +249,24 @@ func (c *conn) ServeRequest(request Request) {
 }
 
 // ServeCommand implements the Conn ServeCommand method.
+// Commands are dropped once the dispatch loop is gone.
 func (c *conn) ServeCommand(cmd ClientCmd) {
-	c.commands <- cmd
+	select {
+	case c.commands <- cmd:
+	case <-c.done:
+	}
+}
+
+// TryServeCommand implements the Conn TryServeCommand method.
+// Like ServeCommand, commands are dropped once the dispatch loop is gone.
+func (c *conn) TryServeCommand(cmd ClientCmd) bool {
+	select {
+	case c.commands <- cmd:
+	case <-c.done:
+	default:
+		return false
+	}
+	return true
 }
 
 // Read implements the Conn Read method.
@@ -268,11 +380,19 @@ func (c *conn) CloseWithError(err *NATSError) {
 			atomic.AddInt64(&c.server.Stats().bad_auth, 1)
 		case ErrUnresponsive:
 			atomic.AddInt64(&c.server.Stats().unresponsive, 1)
+		case ErrMaxUserConns:
+			atomic.AddInt64(&c.server.Stats().max_user_conns, 1)
+		case ErrMaxIPConns:
+			atomic.AddInt64(&c.server.Stats().max_ip_conns, 1)
 		default:
 			atomic.AddInt64(&c.server.Stats().errors, 1)
 		}
 
-		Log.Warnf("[client %s] error: %s", c.RemoteAddr(), err.Message)
+		if len(c.client.Name) > 0 {
+			Log.Warnf("[client %s] [name: %s] error: %s", c.RemoteAddr(), c.client.Name, err.Message)
+		} else {
+			Log.Warnf("[client %s] error: %s", c.RemoteAddr(), err.Message)
+		}
 		c.fatalError <- err
 		c.Close()
 	}
@@ -288,6 +408,20 @@ func (c *conn) HeartbeatHelper() HeartbeatHelper {
 	return c.heartbeatHelper
 }
 
+// AuthHelper implements the Conn AuthHelper method.
+func (c *conn) AuthHelper() *AuthHelper {
+	return c.authHelper
+}
+
+// Account implements the Conn Account method.
+// Routes always belong to the global account.
+func (c *conn) Account() *Account {
+	if c.route != nil {
+		return c.server.Account(GLOBAL_ACCOUNT)
+	}
+	return c.server.Account(c.authHelper.Account())
+}
+
 // Subscriptions implements the Conn Subscriptions method.
 func (c *conn) Subscriptions() map[int]*Subscription {
 	return c.subcriptions
@@ -298,16 +432,60 @@ func (c *conn) Closed() bool {
 	return c.closed
 }
 
+// Id implements the Conn Id method.
+func (c *conn) Id() uint64 {
+	return c.id
+}
+
+// ConnInfo implements the Conn ConnInfo method.
+func (c *conn) ConnInfo() *ConnInfo {
+	info := &ConnInfo{Id: c.id, RemoteAddr: c.RemoteAddr().String(), Route: c.route != nil,
+		User: c.authHelper.User(), Start: c.start, Subscriptions: len(c.subcriptions),
+		Pending: c.Pending(), PingsOutstanding: c.heartbeatHelper.Outstanding(), Options: *c.options,
+		Client: *c.client}
+	if account := c.Account(); account != nil && !account.Global() {
+		info.Account = account.Name
+	}
+	info.InMsgs = atomic.LoadInt64(&c.inMsgs)
+	info.InBytes = atomic.LoadInt64(&c.inBytes)
+	info.OutMsgs = c.outMsgs
+	info.OutBytes = c.outBytes
+	return info
+}
+
 // Options implements the Conn Options method.
 func (c *conn) Options() *ConnOptions {
 	return c.options
 }
 
+// Client implements the Conn Client method.
+func (c *conn) Client() *ClientInfo {
+	return c.client
+}
+
 // RemoteAddr implements the Conn RemoteAddr method.
 func (c *conn) RemoteAddr() net.Addr {
 	return c.tc.RemoteAddr()
 }
 
+// PeerCertificates implements the Conn PeerCertificates method.
+func (c *conn) PeerCertificates() []*x509.Certificate {
+	if tlsConn, ok := c.tc.(*TLSConn); ok {
+		return tlsConn.VerifiedCertificates()
+	}
+	return nil
+}
+
+// Pending implements the Conn Pending method.
+func (c *conn) Pending() int {
+	return int(c.outboxQueue.Size())
+}
+
+// Route implements the Conn Route method.
+func (c *conn) Route() *Route {
+	return c.route
+}
+
 func (c *conn) unregister() {
 	cmd := &UnregisterConnCmd{c, make(chan bool)}
 
@@ -326,6 +504,7 @@ func (c *conn) unregister() {
 
 func (c *conn) dispatchLoop() {
 	defer Log.Debugf("[client %s] stopped dispatch loop", c.RemoteAddr())
+	defer close(c.done)
 
 	c.Write(INFO_REQUEST.Serve(c))
 
@@ -342,6 +521,9 @@ func (c *conn) dispatchLoop() {
 			if !c.closed {
 				c.processRequest(request)
 			}
+			if connect, ok := request.(*ConnectRequest); ok {
+				connect.Done <- true
+			}
 		case command := <-c.commands:
 			command.Process(c)
 		case <-c.authHelper.Timer():
@@ -409,6 +591,9 @@ func (c *conn) writeLoop() {
 			c.commands <- &ErrorCmd{err}
 			break
 		}
+		if !response.Delivered.IsZero() {
+			c.server.Stats().write_latency.Observe(int64(time.Since(response.Delivered) / time.Microsecond))
+		}
 
 		if !c.outboxQueue.HasMore() {
 			err := c.writer.Flush()
@@ -434,23 +619,45 @@ func (c *conn) writeFatalError() {
 }
 
 func (c *conn) processMessage(subscribedMessage *SubscribedMessage) {
+	if subscribedMessage.Interest != nil {
+		c.Write(subscribedMessage.Interest)
+		return
+	}
+
 	message := subscribedMessage.Message
 	subscription := subscribedMessage.Subscription
-
-	if len(message.ReplyTo) > 0 {
+	c.outMsgs++
+	c.outBytes += int64(message.Size())
+
+	if message.Header != nil {
+		var header string
+		if len(message.ReplyTo) > 0 {
+			header = fmt.Sprintf("HMSG %s %d %s %d %d\r\n%s", message.Subject, subscription.Id,
+				message.ReplyTo, len(message.Header.Raw), message.Size(), message.Header.Raw)
+		} else {
+			header = fmt.Sprintf("HMSG %s %d %d %d\r\n%s", message.Subject, subscription.Id,
+				len(message.Header.Raw), message.Size(), message.Header.Raw)
+		}
+		c.Write(&Response{Value: &header, Bytes: &message.Content, Delivered: subscribedMessage.Delivered})
+	} else if len(message.ReplyTo) > 0 {
 		header := fmt.Sprintf("MSG %s %d %s %d\r\n", message.Subject, subscription.Id, message.ReplyTo,
 			len(message.Content))
-		c.Write(&Response{Value: &header, Bytes: &message.Content})
+		c.Write(&Response{Value: &header, Bytes: &message.Content, Delivered: subscribedMessage.Delivered})
 	} else {
 		header := fmt.Sprintf("MSG %s %d %d\r\n", message.Subject, subscription.Id,
 			len(message.Content))
-		c.Write(&Response{Value: &header, Bytes: &message.Content})
+		c.Write(&Response{Value: &header, Bytes: &message.Content, Delivered: subscribedMessage.Delivered})
 	}
 }
 
 func (c *conn) processRequest(request Request) {
 	authorized, err := c.authHelper.Auth(request)
 	if authorized {
+		if _, ok := request.(*ConnectRequest); ok && c.route == nil &&
+			!c.server.RegisterUser(c, c.authHelper.User()) {
+			c.CloseWithError(ErrMaxUserConns)
+			return
+		}
 		response := request.Serve(c)
 		if response != nil {
 			c.Write(response)
@@ -461,14 +668,53 @@ func (c *conn) processRequest(request Request) {
 }
 
 func (c *conn) processLine(command, args string) error {
-	if parseFunc, found := REQUEST_PARSERS[strings.ToUpper(command)]; found {
+	command = strings.ToUpper(command)
+	if parseFunc, found := c.parsers[command]; found {
 		atomic.AddInt64(c.server.Stats().ops[command], 1)
 		request, err := parseFunc(c, args)
 		if err != nil {
 			return err
 		}
+		if publish, ok := request.(*PublishRequest); ok {
+			err = c.limitPublish(publish)
+			if err != nil {
+				return err
+			}
+			atomic.AddInt64(&c.inMsgs, 1)
+			atomic.AddInt64(&c.inBytes, int64(publish.Message.Size()))
+		}
 		request.Dispatch(c)
 		return nil
 	}
 	return ErrUnknownOp
 }
+
+// Enforce the publish rate limits of the connection, either by sleeping
+// which stops reading from the client, or by rejecting the message.
+// The limits are picked on the first publish, once the user is known.
+func (c *conn) limitPublish(request *PublishRequest) error {
+	limits := &c.server.Config().Limits
+	if !c.rateLimiterReady {
+		c.rateLimiter = NewRateLimiter(limits.PublishLimits(c.authHelper.User()), time.Now())
+		c.rateLimiterReady = true
+	}
+	if c.rateLimiter == nil {
+		return nil
+	}
+
+	size := request.Message.Size()
+	if limits.PublishAction == PUBLISH_ERROR {
+		if !c.rateLimiter.Allow(size, time.Now()) {
+			atomic.AddInt64(&c.server.Stats().rate_limited, 1)
+			return ErrRateLimited
+		}
+		return nil
+	}
+
+	wait := c.rateLimiter.Wait(size, time.Now())
+	if wait > 0 {
+		atomic.AddInt64(&c.server.Stats().throttled, 1)
+		time.Sleep(wait)
+	}
+	return nil
+}
@@ -58,9 +58,12 @@ func (s *ConnSuite) TearDownTest(c *C) {
 
 	if s.conn != nil {
 		if !s.conn.Closed() {
+			// The next test replaces these, so grab them now
+			serverCmds, client := s.serverCmds, s.tcpConn.client
+
 			// Dummy server unregister mock
 			go func() {
-				cmd := <-s.serverCmds
+				cmd := <-serverCmds
 				switch cmd.(type) {
 				case *UnregisterConnCmd:
 					cmd := cmd.(*UnregisterConnCmd)
@@ -72,7 +75,7 @@ func (s *ConnSuite) TearDownTest(c *C) {
 			go func() {
 				buf := make([]byte, 1024)
 				for {
-					_, err := s.tcpConn.client.Read(buf)
+					_, err := client.Read(buf)
 					if err != nil {
 						break
 					}
@@ -169,7 +172,8 @@ func (s *ConnSuite) TestMessageDispatch(c *C) {
 	s.conn = NewConn(s.server, s.tcpConn)
 	go s.conn.Start()
 
-	sm := &SubscribedMessage{&Subscription{}, &Message{"foo", "X", []byte("msg")}, false}
+	message := &Message{Subject: "foo", ReplyTo: "X", Content: []byte("msg")}
+	sm := &SubscribedMessage{Subscription: &Subscription{}, Message: message, Delivered: time.Now()}
 	s.conn.ServeMessage(sm)
 
 	reader := bufio.NewReader(s.tcpConn.client)
@@ -178,6 +182,40 @@ func (s *ConnSuite) TestMessageDispatch(c *C) {
 	checkReadLine(c, reader, "msg")
 }
 
+func (s *ConnSuite) TestInterestDispatch(c *C) {
+	s.delegate.Set(c)
+	defer s.ctrl.Finish()
+
+	s.conn = NewConn(s.server, s.tcpConn)
+	go s.conn.Start()
+
+	s.conn.ServeMessage(&SubscribedMessage{Interest: NewStringResponse("SUB foo 1")})
+
+	reader := bufio.NewReader(s.tcpConn.client)
+	reader.ReadLine()
+	checkReadLine(c, reader, "SUB foo 1")
+}
+
+func (s *ConnSuite) TestHeaderMessageDispatch(c *C) {
+	s.delegate.Set(c)
+	defer s.ctrl.Finish()
+
+	s.conn = NewConn(s.server, s.tcpConn)
+	go s.conn.Start()
+
+	header, _ := ParseHeader([]byte("NATS/1.0\r\nA: b\r\n\r\n"))
+	message := &Message{Subject: "foo", ReplyTo: "X", Content: []byte("msg"), Header: header}
+	s.conn.ServeMessage(&SubscribedMessage{Subscription: &Subscription{Id: 2}, Message: message})
+
+	reader := bufio.NewReader(s.tcpConn.client)
+	reader.ReadLine()
+	checkReadLine(c, reader, "HMSG foo 2 X 18 21")
+	checkReadLine(c, reader, "NATS/1.0")
+	checkReadLine(c, reader, "A: b")
+	checkReadLine(c, reader, "")
+	checkReadLine(c, reader, "msg")
+}
+
 type TestRequest struct{}
 
 func (t *TestRequest) Serve(c Conn) *Response {
@@ -313,6 +351,53 @@ func (s *ConnSuite) TestReadUnknownRequest(c *C) {
 	checkReadLine(c, reader, "-ERR 'Unknown Protocol Operation'")
 }
 
+func (s *ConnSuite) TestRouteMessageUnauthorized(c *C) {
+	s.delegate.Set(c)
+	defer s.ctrl.Finish()
+
+	s.server.Config().Limits.Payload = 16
+	s.server.Config().Cluster.User = "route"
+	s.server.Config().Cluster.Password = "secret"
+	s.conn = NewRouteConn(s.server, s.tcpConn, &Route{})
+	go s.conn.Start()
+
+	// The route is dropped without the message reaching the server
+	go func() {
+		cmd := <-s.serverCmds
+		c.Check(cmd, FitsTypeOf, &UnregisterConnCmd{})
+		switch cmd.(type) {
+		case *UnregisterConnCmd:
+			cmd := cmd.(*UnregisterConnCmd)
+			cmd.Done <- true
+		}
+	}()
+
+	io.WriteString(s.tcpConn.client, "MSG foo 1 3\r\nbar\r\n")
+
+	reader := bufio.NewReader(s.tcpConn.client)
+	reader.ReadLine()
+	checkReadLine(c, reader, "-ERR 'Authorization is required'")
+}
+
+func (s *ConnSuite) TestRouteMessageAuthorized(c *C) {
+	s.delegate.Set(c)
+	defer s.ctrl.Finish()
+
+	s.server.Config().Limits.ControlLine = 1024
+	s.server.Config().Limits.Payload = 16
+	s.server.Config().Cluster.User = "route"
+	s.server.Config().Cluster.Password = "secret"
+	s.conn = NewRouteConn(s.server, s.tcpConn, &Route{})
+	go s.conn.Start()
+
+	io.WriteString(s.tcpConn.client, `CONNECT {"user":"route","pass":"secret"}`+"\r\nMSG foo 1 3\r\nbar\r\n")
+
+	serverCmd := <-s.serverCmds
+	c.Assert(serverCmd, FitsTypeOf, &RoutedMessageCmd{})
+	c.Check(serverCmd.(*RoutedMessageCmd).SubscriptionId, Equals, 1)
+	c.Check(string(serverCmd.(*RoutedMessageCmd).Message.Content), Equals, "bar")
+}
+
 func (s *ConnSuite) TestClientClosed(c *C) {
 	s.delegate.Set(c)
 	defer s.ctrl.Finish()
@@ -325,6 +410,37 @@ func (s *ConnSuite) TestClientClosed(c *C) {
 	(serverCmd.(*UnregisterConnCmd)).Done <- true
 }
 
+func (s *ConnSuite) TestServeCommandClosed(c *C) {
+	s.delegate.Set(c)
+	defer s.ctrl.Finish()
+
+	s.conn = NewConn(s.server, s.tcpConn)
+	done := make(chan bool)
+	go func() {
+		s.conn.Start()
+		done <- true
+	}()
+
+	s.tcpConn.client.Close()
+	serverCmd := <-s.serverCmds
+	(serverCmd.(*UnregisterConnCmd)).Done <- true
+	<-done
+
+	for i := 0; i < MAX_CONN_CHAN_BACKLOG+1; i++ {
+		s.conn.ServeCommand(&TestClientCmd{})
+	}
+}
+
+func (s *ConnSuite) TestPending(c *C) {
+	s.delegate.Set(c)
+	defer s.ctrl.Finish()
+
+	s.conn = NewConn(s.server, s.tcpConn)
+	c.Check(s.conn.Pending(), Equals, 0)
+	s.conn.Write(NewStringResponse("12345"))
+	c.Check(s.conn.Pending(), Equals, 5)
+}
+
 type TestServerCmd struct{}
 
 func (c *TestServerCmd) Process(Server) {
@@ -396,6 +512,18 @@ func (s *ConnSuite) TestSendServerCmdFull(c *C) {
 	<-barrier
 }
 
+func (s *ConnSuite) TestTryServeCommandFull(c *C) {
+	s.delegate.Set(c)
+	defer s.ctrl.Finish()
+
+	// Not started, so nothing drains the commands
+	conn := NewConn(s.server, s.tcpConn)
+	for i := 0; i < MAX_CONN_CHAN_BACKLOG; i++ {
+		c.Check(conn.TryServeCommand(&CallbackClientCmd{}), Equals, true)
+	}
+	c.Check(conn.TryServeCommand(&CallbackClientCmd{}), Equals, false)
+}
+
 func (s *ConnSuite) TestWriteFull(c *C) {
 	s.delegate.Set(c)
 	defer s.ctrl.Finish()
@@ -423,6 +551,68 @@ func (s *ConnSuite) TestWriteFull(c *C) {
 	checkReadLine(c, reader, "-ERR 'Slow consumer detected, connection dropped'")
 }
 
+func (s *ConnSuite) TestPublishRateLimited(c *C) {
+	s.delegate.Set(c)
+	defer s.ctrl.Finish()
+
+	stats := NewStats()
+	server := NewMockServer(s.ctrl)
+	server.EXPECT().Config().Return(s.server.Config()).AnyTimes()
+	server.EXPECT().Info().Return(&dummyInfo).AnyTimes()
+	server.EXPECT().Commands().Return(s.serverCmds).AnyTimes()
+	server.EXPECT().Stats().Return(stats).AnyTimes()
+	server.EXPECT().Account("").Return(NewAccount(GLOBAL_ACCOUNT))
+	s.server = server
+
+	s.server.Config().Limits.Payload = 16
+	s.server.Config().Limits.Publish.Messages = 1
+	s.server.Config().Limits.PublishAction = PUBLISH_ERROR
+	s.conn = NewConn(s.server, s.tcpConn)
+	go s.conn.Start()
+
+	io.WriteString(s.tcpConn.client, "PUB foo 1\r\nx\r\nPUB foo 1\r\nx\r\n")
+
+	reader := bufio.NewReader(s.tcpConn.client)
+	reader.ReadLine()
+	checkReadLine(c, reader, "OK")
+	checkReadLine(c, reader, "-ERR 'Publish rate limit exceeded'")
+	c.Check(<-s.serverCmds, FitsTypeOf, &PublishCmd{})
+}
+
+func (s *ConnSuite) TestConnInfo(c *C) {
+	s.delegate.Set(c)
+	defer s.ctrl.Finish()
+
+	s.heartbeatHelper.EXPECT().Outstanding().Return(2)
+	s.server.EXPECT().Account("").Return(NewAccount(GLOBAL_ACCOUNT))
+
+	s.conn = NewConn(s.server, s.tcpConn)
+	go s.conn.Start()
+
+	reader := bufio.NewReader(s.tcpConn.client)
+	reader.ReadLine()
+
+	s.conn.Subscriptions()[1] = &Subscription{}
+	message := &Message{Subject: "foo", Content: []byte("msg")}
+	s.conn.ServeMessage(&SubscribedMessage{Subscription: &Subscription{}, Message: message})
+	checkReadLine(c, reader, "MSG foo 0 3")
+	checkReadLine(c, reader, "msg")
+
+	cmd := &ConnInfoCmd{make(chan *ConnInfo, 1)}
+	s.conn.ServeCommand(cmd)
+	info := <-cmd.Info
+	c.Check(info.Id > 0, Equals, true)
+	c.Check(info.RemoteAddr, Equals, "pipe")
+	c.Check(info.Subscriptions, Equals, 1)
+	c.Check(info.OutMsgs, Equals, int64(1))
+	c.Check(info.OutBytes, Equals, int64(3))
+	c.Check(info.PingsOutstanding, Equals, 2)
+	c.Check(info.Options, DeepEquals, ConnOptions{Verbose: true, Pedantic: true, Echo: true})
+	c.Check(info.Route, Equals, false)
+	c.Check(info.Account, Equals, "")
+	c.Check(info.Client, Equals, ClientInfo{})
+}
+
 func checkReadLine(c *C, reader *bufio.Reader, expected string) {
 	line, prefix, err := reader.ReadLine()
 	c.Check(err, IsNil)
@@ -0,0 +1,98 @@
+// Copyright (c) 2012 VMware, Inc.
+
+package gonatsd
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+const (
+	DEFAULT_CONNZ_LIMIT = 1024
+	CONNZ_TIMEOUT       = 2 * time.Second
+)
+
+// Snapshot of a connection for /connz.
+type ConnInfo struct {
+	Id               uint64      `json:"cid"`
+	RemoteAddr       string      `json:"remote_addr"`
+	Route            bool        `json:"route,omitempty"`
+	User             string      `json:"user,omitempty"`
+	Account          string      `json:"account,omitempty"`
+	Start            time.Time   `json:"start"`
+	Subscriptions    int         `json:"subscriptions"`
+	InMsgs           int64       `json:"in_msgs"`
+	InBytes          int64       `json:"in_bytes"`
+	OutMsgs          int64       `json:"out_msgs"`
+	OutBytes         int64       `json:"out_bytes"`
+	Pending          int         `json:"pending_bytes"`
+	PingsOutstanding int         `json:"pings_outstanding"`
+	Options          ConnOptions `json:"options"`
+	Client           ClientInfo  `json:"client"`
+}
+
+// A page of connections sorted by one of the CONNZ_SORTS.
+type Connz struct {
+	Now    time.Time   `json:"now"`
+	Total  int         `json:"total"`
+	Offset int         `json:"offset"`
+	Limit  int         `json:"limit"`
+	Sort   string      `json:"sort"`
+	Conns  []*ConnInfo `json:"connections"`
+}
+
+// Ways to sort the connections, by id and start time ascending, the
+// others descending.
+var CONNZ_SORTS = map[string]func(a, b *ConnInfo) bool{
+	"cid":       func(a, b *ConnInfo) bool { return a.Id < b.Id },
+	"start":     func(a, b *ConnInfo) bool { return a.Start.Before(b.Start) },
+	"subs":      func(a, b *ConnInfo) bool { return a.Subscriptions > b.Subscriptions },
+	"pending":   func(a, b *ConnInfo) bool { return a.Pending > b.Pending },
+	"msgs_in":   func(a, b *ConnInfo) bool { return a.InMsgs > b.InMsgs },
+	"msgs_out":  func(a, b *ConnInfo) bool { return a.OutMsgs > b.OutMsgs },
+	"bytes_in":  func(a, b *ConnInfo) bool { return a.InBytes > b.InBytes },
+	"bytes_out": func(a, b *ConnInfo) bool { return a.OutBytes > b.OutBytes },
+}
+
+type connInfoSorter struct {
+	conns []*ConnInfo
+	less  func(a, b *ConnInfo) bool
+}
+
+func (s *connInfoSorter) Len() int           { return len(s.conns) }
+func (s *connInfoSorter) Swap(i, j int)      { s.conns[i], s.conns[j] = s.conns[j], s.conns[i] }
+func (s *connInfoSorter) Less(i, j int) bool { return s.less(s.conns[i], s.conns[j]) }
+
+// Sort the connections and return the requested page.
+// An empty sort means by id, a limit of 0 the default limit.
+func NewConnz(conns []*ConnInfo, sortBy string, offset, limit int) (*Connz, error) {
+	if len(sortBy) == 0 {
+		sortBy = "cid"
+	}
+	less, ok := CONNZ_SORTS[sortBy]
+	if !ok {
+		return nil, fmt.Errorf("invalid sort '%s'", sortBy)
+	}
+	if offset < 0 || limit < 0 {
+		return nil, fmt.Errorf("invalid offset or limit")
+	}
+	if limit == 0 {
+		limit = DEFAULT_CONNZ_LIMIT
+	}
+
+	// Ties keep the id order
+	sort.Sort(&connInfoSorter{conns, CONNZ_SORTS["cid"]})
+	sort.Stable(&connInfoSorter{conns, less})
+
+	connz := &Connz{Now: time.Now().UTC(), Total: len(conns), Offset: offset, Limit: limit, Sort: sortBy}
+	if offset > len(conns) {
+		offset = len(conns)
+	}
+	end := offset + limit
+	if end > len(conns) {
+		end = len(conns)
+	}
+	connz.Conns = conns[offset:end]
+	return connz, nil
+}
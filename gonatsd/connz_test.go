@@ -0,0 +1,72 @@
+// Copyright (c) 2012 VMware, Inc.
+
+package gonatsd_test
+
+import (
+	. "gonatsd/gonatsd"
+	. "launchpad.net/gocheck"
+	"time"
+)
+
+type ConnzSuite struct{}
+
+var _ = Suite(&ConnzSuite{})
+
+func newTestConnInfos() []*ConnInfo {
+	start := time.Now()
+	return []*ConnInfo{
+		&ConnInfo{Id: 3, Start: start.Add(-time.Minute), Subscriptions: 1, InMsgs: 5},
+		&ConnInfo{Id: 1, Start: start, Subscriptions: 7, InMsgs: 5},
+		&ConnInfo{Id: 2, Start: start.Add(-time.Hour), Subscriptions: 2, InMsgs: 9},
+	}
+}
+
+func connIds(connz *Connz) []uint64 {
+	ids := make([]uint64, 0, len(connz.Conns))
+	for _, conn := range connz.Conns {
+		ids = append(ids, conn.Id)
+	}
+	return ids
+}
+
+func (s *ConnzSuite) TestSort(c *C) {
+	sorts := map[string][]uint64{
+		"":        []uint64{1, 2, 3},
+		"cid":     []uint64{1, 2, 3},
+		"start":   []uint64{2, 3, 1},
+		"subs":    []uint64{1, 2, 3},
+		"msgs_in": []uint64{2, 1, 3},
+	}
+	for sortBy, ids := range sorts {
+		connz, err := NewConnz(newTestConnInfos(), sortBy, 0, 0)
+		c.Assert(err, IsNil)
+		c.Check(connIds(connz), DeepEquals, ids, Commentf("sort: %s", sortBy))
+		c.Check(connz.Total, Equals, 3)
+		c.Check(connz.Limit, Equals, DEFAULT_CONNZ_LIMIT)
+	}
+}
+
+func (s *ConnzSuite) TestPaging(c *C) {
+	connz, err := NewConnz(newTestConnInfos(), "cid", 1, 1)
+	c.Assert(err, IsNil)
+	c.Check(connIds(connz), DeepEquals, []uint64{2})
+	c.Check(connz.Total, Equals, 3)
+	c.Check(connz.Offset, Equals, 1)
+	c.Check(connz.Limit, Equals, 1)
+
+	connz, err = NewConnz(newTestConnInfos(), "cid", 2, 5)
+	c.Assert(err, IsNil)
+	c.Check(connIds(connz), DeepEquals, []uint64{3})
+
+	connz, err = NewConnz(newTestConnInfos(), "cid", 5, 5)
+	c.Assert(err, IsNil)
+	c.Check(connz.Conns, HasLen, 0)
+}
+
+func (s *ConnzSuite) TestInvalid(c *C) {
+	_, err := NewConnz(newTestConnInfos(), "name", 0, 0)
+	c.Check(err, ErrorMatches, "invalid sort 'name'")
+
+	_, err = NewConnz(newTestConnInfos(), "cid", -1, 0)
+	c.Check(err, NotNil)
+}
@@ -17,11 +17,25 @@ var (
 	ErrInvalidSubject    = &NATSError{"-ERR 'Invalid Subject'", false}
 	ErrInvalidSidTaken   = &NATSError{"-ERR 'Invalid Subject Identifier (sid), already taken'", false}
 	ErrInvalidSidNoexist = &NATSError{"-ERR 'Invalid Subject-Identifier (sid), no subscriber registered'", false}
+	ErrSubjectTooLong    = &NATSError{"-ERR 'Subject length exceeded'", false}
+	ErrSubjectTooDeep    = &NATSError{"-ERR 'Subject token count exceeded'", false}
+	ErrMaxSubsExceeded   = &NATSError{"-ERR 'Maximum subscriptions exceeded'", false}
+	ErrInvalidHeader     = &NATSError{"-ERR 'Invalid Header'", false}
+	ErrUnknownProtocol   = &NATSError{"-ERR 'Unsupported protocol version, connection dropped'", true}
 	ErrInvalidConfig     = &NATSError{"-ERR 'Invalid config, valid JSON required for connection configuration'", false}
 	ErrAuthRequired      = &NATSError{"-ERR 'Authorization is required'", true}
 	ErrAuthFailed        = &NATSError{"-ERR 'Authorization failed'", true}
+	ErrAuthRevoked       = &NATSError{"-ERR 'Authorization revoked, connection dropped'", true}
+	ErrPermissions       = &NATSError{"-ERR 'Permissions Violation'", false}
+	ErrRateLimited       = &NATSError{"-ERR 'Publish rate limit exceeded'", false}
 	ErrUnknownOp         = &NATSError{"-ERR 'Unknown Protocol Operation'", false}
 	ErrSlowConsumer      = &NATSError{"-ERR 'Slow consumer detected, connection dropped'", true}
 	ErrUnresponsive      = &NATSError{"-ERR 'Unresponsive client detected, connection dropped'", true}
 	ErrMaxConnsExceeded  = &NATSError{"-ERR 'Maximum client connections exceeded, connection dropped'", true}
+	ErrMaxUserConns      = &NATSError{"-ERR 'Maximum connections for user exceeded, connection dropped'", true}
+	ErrMaxIPConns        = &NATSError{"-ERR 'Maximum connections from address exceeded, connection dropped'", true}
+	ErrDuplicateRoute    = &NATSError{"-ERR 'Duplicate route, connection dropped'", true}
+	ErrInvalidRouteInfo  = &NATSError{"-ERR 'Invalid route INFO, connection dropped'", true}
+	ErrServerShutdown    = &NATSError{"-ERR 'Server shutting down, connection dropped'", true}
+	ErrServerLameDuck    = &NATSError{"-ERR 'Server in lame duck mode, connection dropped'", true}
 )
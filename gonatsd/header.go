@@ -0,0 +1,58 @@
+// Copyright (c) 2012 VMware, Inc.
+
+package gonatsd
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+)
+
+const (
+	HEADER_VERSION = "NATS/1.0"
+	HEADER_MIN_LEN = len(HEADER_VERSION) + 4 // version line and empty line
+
+	NO_RESPONDERS_STATUS = "503"
+)
+
+var headerEnd = []byte("\r\n\r\n")
+
+// Message header block: a version line with an optional status, followed
+// by "Key: Value" lines and an empty line. The raw block is what gets
+// delivered, the parsed fields are only for the server to look at.
+type Header struct {
+	Raw    []byte
+	Status string
+	Values map[string][]string
+}
+
+// Parse and validate a header block.
+func ParseHeader(raw []byte) (*Header, error) {
+	if len(raw) < HEADER_MIN_LEN || !bytes.HasPrefix(raw, []byte(HEADER_VERSION)) ||
+		!bytes.HasSuffix(raw, headerEnd) {
+		return nil, errors.New("invalid header block")
+	}
+
+	lines := strings.Split(string(raw[:len(raw)-len(headerEnd)]), "\r\n")
+	header := &Header{Raw: raw, Values: make(map[string][]string)}
+	header.Status = strings.TrimSpace(lines[0][len(HEADER_VERSION):])
+	if len(header.Status) > 0 && lines[0][len(HEADER_VERSION)] != ' ' {
+		return nil, errors.New("invalid header version")
+	}
+
+	for _, line := range lines[1:] {
+		colon := strings.Index(line, ":")
+		if colon <= 0 || strings.ContainsAny(line[:colon], " \t") {
+			return nil, errors.New("invalid header line")
+		}
+		key := line[:colon]
+		header.Values[key] = append(header.Values[key], strings.TrimSpace(line[colon+1:]))
+	}
+	return header, nil
+}
+
+// Create a header block with only a status.
+func NewStatusHeader(status string) *Header {
+	raw := []byte(HEADER_VERSION + " " + status + "\r\n\r\n")
+	return &Header{Raw: raw, Status: status, Values: make(map[string][]string)}
+}
@@ -0,0 +1,42 @@
+// Copyright (c) 2012 VMware, Inc.
+
+package gonatsd_test
+
+import (
+	. "gonatsd/gonatsd"
+	. "launchpad.net/gocheck"
+)
+
+type HeaderSuite struct{}
+
+var _ = Suite(&HeaderSuite{})
+
+func (s *HeaderSuite) TestParseHeader(c *C) {
+	raw := []byte("NATS/1.0\r\nTrace-Id: abc\r\nAccept: a\r\nAccept:b\r\n\r\n")
+	header, err := ParseHeader(raw)
+	c.Assert(err, IsNil)
+	c.Check(header.Raw, DeepEquals, raw)
+	c.Check(header.Status, Equals, "")
+	c.Check(header.Values, DeepEquals, map[string][]string{"Trace-Id": {"abc"}, "Accept": {"a", "b"}})
+
+	header, err = ParseHeader([]byte("NATS/1.0 503\r\n\r\n"))
+	c.Assert(err, IsNil)
+	c.Check(header.Status, Equals, "503")
+	c.Check(header.Values, HasLen, 0)
+}
+
+func (s *HeaderSuite) TestParseHeaderInvalid(c *C) {
+	blocks := []string{
+		"",
+		"NATS/1.0\r\n",
+		"NATS/2.0\r\n\r\n",
+		"NATS/1.0503\r\n\r\n",
+		"NATS/1.0\r\nno colon\r\n\r\n",
+		"NATS/1.0\r\nbad key: a\r\n\r\n",
+		"NATS/1.0\r\n\r\nA: b\r\n\r\n",
+	}
+	for _, block := range blocks {
+		_, err := ParseHeader([]byte(block))
+		c.Check(err, NotNil, Commentf("header: %q", block))
+	}
+}
@@ -11,6 +11,7 @@ type HeartbeatHelper interface {
 	Ping()
 	Pong()
 	Stop()
+	Outstanding() int
 }
 
 type heartbeatHelper struct {
@@ -53,6 +54,11 @@ func (h *heartbeatHelper) Pong() {
 	}
 }
 
+// Returns the number of pings the client didn't answer yet.
+func (h *heartbeatHelper) Outstanding() int {
+	return h.outstanding
+}
+
 func (h *heartbeatHelper) Stop() {
 	if h.ticker != nil {
 		h.ticker.Stop()
@@ -3,7 +3,12 @@
 package gonatsd
 
 import (
+	"bytes"
 	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"sort"
 	"strconv"
 	"sync"
 	"time"
@@ -11,6 +16,20 @@ import (
 
 const (
 	DEFAULT_RATE_UPDATE_INTERVAL = 5 * time.Second
+
+	DEFAULT_HISTOGRAM_WINDOW = 1 * time.Minute
+	MAX_HISTOGRAM_SAMPLES    = 1024 // per rate update interval
+
+	DEFAULT_PUSH_INTERVAL = 10 * time.Second
+	DEFAULT_PUSH_PREFIX   = "gnatsd"
+	PUSH_DIAL_TIMEOUT     = 2 * time.Second
+	MAX_STATSD_PACKET     = 1432 // fits in an ethernet frame
+)
+
+// Where pushed metrics go.
+const (
+	PUSH_STATSD   = "statsd"   // UDP
+	PUSH_GRAPHITE = "graphite" // plaintext TCP
 )
 
 type StringVal struct {
@@ -73,6 +92,116 @@ func (r *Rate) Snapshot(ts int64) {
 	r.index = (r.index + 1) % len(r.buckets)
 }
 
+// Distribution of the values observed in a sliding window.
+type HistogramSnapshot struct {
+	Count int64 `json:"count"`
+	P50   int64 `json:"p50"`
+	P90   int64 `json:"p90"`
+	P99   int64 `json:"p99"`
+	Max   int64 `json:"max"`
+}
+
+type histogramBucket struct {
+	samples []int64
+	count   int64
+	max     int64
+}
+
+// A Histogram keeps a uniform sample of the values observed during each
+// rate update interval of its window, so the percentiles are approximate
+// but the max is exact. The buckets are rotated by the registry.
+// It's safe to use concurrently.
+type Histogram struct {
+	buckets []histogramBucket
+	index   int
+	count   int64 // since creation
+	sum     int64 // since creation
+	lock    *sync.Mutex
+}
+
+// Create a histogram over the window, rounded to the rate update interval.
+func NewHistogram(window time.Duration) *Histogram {
+	numBuckets := window / DEFAULT_RATE_UPDATE_INTERVAL
+	if numBuckets < 2 {
+		numBuckets = 2
+	}
+	return &Histogram{buckets: make([]histogramBucket, numBuckets), lock: &sync.Mutex{}}
+}
+
+func (h *Histogram) Observe(value int64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.count++
+	h.sum += value
+
+	bucket := &h.buckets[h.index]
+	bucket.count++
+	if value > bucket.max {
+		bucket.max = value
+	}
+	if len(bucket.samples) < MAX_HISTOGRAM_SAMPLES {
+		bucket.samples = append(bucket.samples, value)
+	} else if i := rand.Int63n(bucket.count); i < MAX_HISTOGRAM_SAMPLES {
+		bucket.samples[i] = value
+	}
+}
+
+// Start a new bucket, dropping the oldest one.
+func (h *Histogram) Rotate() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.index = (h.index + 1) % len(h.buckets)
+	bucket := &h.buckets[h.index]
+	bucket.samples, bucket.count, bucket.max = bucket.samples[:0], 0, 0
+}
+
+// Returns the distribution of the values in the window.
+func (h *Histogram) Snapshot() *HistogramSnapshot {
+	h.lock.Lock()
+	snapshot := &HistogramSnapshot{}
+	samples := make([]int64, 0, MAX_HISTOGRAM_SAMPLES)
+	for _, bucket := range h.buckets {
+		snapshot.Count += bucket.count
+		if bucket.max > snapshot.Max {
+			snapshot.Max = bucket.max
+		}
+		samples = append(samples, bucket.samples...)
+	}
+	h.lock.Unlock()
+
+	if len(samples) == 0 {
+		return snapshot
+	}
+	sort.Sort(int64Slice(samples))
+	// Nearest rank
+	quantile := func(q float64) int64 {
+		return samples[int(math.Ceil(q*float64(len(samples))))-1]
+	}
+	snapshot.P50, snapshot.P90, snapshot.P99 = quantile(0.5), quantile(0.9), quantile(0.99)
+	return snapshot
+}
+
+// Returns the number and the sum of the values observed since creation.
+func (h *Histogram) Totals() (int64, int64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.count, h.sum
+}
+
+func (h *Histogram) String() string {
+	snapshot := h.Snapshot()
+	return fmt.Sprintf("count=%d p50=%d p90=%d p99=%d max=%d", snapshot.Count, snapshot.P50, snapshot.P90,
+		snapshot.P99, snapshot.Max)
+}
+
+type int64Slice []int64
+
+func (s int64Slice) Len() int           { return len(s) }
+func (s int64Slice) Less(i, j int) bool { return s[i] < s[j] }
+func (s int64Slice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
 type Registry struct {
 	lock     *sync.RWMutex
 	metrics  map[string]fmt.Stringer
@@ -101,6 +230,8 @@ func (r *Registry) Loop() {
 				case *Rate:
 					rate := metric.(*Rate)
 					rate.Snapshot(ts)
+				case *Histogram:
+					metric.(*Histogram).Rotate()
 				}
 			}
 			r.lock.RUnlock()
@@ -148,6 +279,12 @@ func (r *Registry) NewRates(name string, addr *int64, durations ...string) {
 	}
 }
 
+func (r *Registry) AddHistogram(name string, histogram *Histogram) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.metrics[name] = histogram
+}
+
 type Gauge struct {
 	fn func() string
 }
@@ -176,4 +313,114 @@ func (r *Registry) Metrics(fn func(map[string]fmt.Stringer)) {
 	fn(r.metrics)
 }
 
+// A Pusher periodically sends the numeric metrics of a registry to StatsD
+// or Graphite. StatsD gets counters as the increment since the last push,
+// gauges and rates as gauges, histograms as gauges of their percentiles.
+// String values are never pushed.
+type Pusher struct {
+	registry *Registry
+	protocol string
+	address  string
+	prefix   string
+	interval time.Duration
+	counters map[string]int64 // last pushed counter values
+}
+
+// Create a pusher for the registry, the config must be valid.
+func NewPusher(registry *Registry, config *MetricsPushConfig) *Pusher {
+	return &Pusher{registry: registry, protocol: config.Protocol, address: config.Address,
+		prefix: config.Prefix, interval: config.IntervalDuration, counters: make(map[string]int64)}
+}
+
+// Push the metrics every interval, forever.
+func (p *Pusher) Loop() {
+	ticker := time.NewTicker(p.interval)
+	for {
+		select {
+		case t := <-ticker.C:
+			err := p.Push(t)
+			if err != nil {
+				Log.Warnf("Failed to push metrics to %s: %s", p.address, err.Error())
+			}
+		}
+	}
+}
+
+// Send the current values of the metrics.
+func (p *Pusher) Push(now time.Time) error {
+	lines := make([]string, 0, 64)
+	p.registry.Metrics(func(metrics map[string]fmt.Stringer) {
+		for name, metric := range metrics {
+			switch metric.(type) {
+			case *StringVal:
+			case *Counter:
+				// Counters start at 0 so the first push sends their whole value.
+				current := *metric.(*Counter).addr
+				if p.protocol == PUSH_STATSD {
+					lines = append(lines, fmt.Sprintf("%s:%d|c\n", p.name(name), current-p.counters[name]))
+					p.counters[name] = current
+				} else {
+					lines = append(lines, p.gauge(name, fmt.Sprint(current), now))
+				}
+			case *Histogram:
+				snapshot := metric.(*Histogram).Snapshot()
+				lines = append(lines, p.gauge(name+".p50", fmt.Sprint(snapshot.P50), now),
+					p.gauge(name+".p90", fmt.Sprint(snapshot.P90), now),
+					p.gauge(name+".p99", fmt.Sprint(snapshot.P99), now),
+					p.gauge(name+".max", fmt.Sprint(snapshot.Max), now))
+			default:
+				value := metric.String()
+				if _, err := strconv.ParseFloat(value, 64); err == nil {
+					lines = append(lines, p.gauge(name, value, now))
+				}
+			}
+		}
+	})
+
+	if p.protocol == PUSH_STATSD {
+		return p.send("udp", lines, MAX_STATSD_PACKET)
+	}
+	return p.send("tcp", lines, 0)
+}
+
+func (p *Pusher) name(name string) string {
+	if len(p.prefix) > 0 {
+		return p.prefix + "." + name
+	}
+	return name
+}
+
+func (p *Pusher) gauge(name string, value string, now time.Time) string {
+	if p.protocol == PUSH_GRAPHITE {
+		return fmt.Sprintf("%s %s %d\n", p.name(name), value, now.Unix())
+	}
+	return fmt.Sprintf("%s:%s|g\n", p.name(name), value)
+}
+
+// Write the lines in as few writes as possible, each at most max bytes
+// unless max is 0.
+func (p *Pusher) send(network string, lines []string, max int) error {
+	conn, err := net.DialTimeout(network, p.address, PUSH_DIAL_TIMEOUT)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetWriteDeadline(time.Now().Add(p.interval))
+
+	buf := &bytes.Buffer{}
+	for _, line := range lines {
+		if max > 0 && buf.Len() > 0 && buf.Len()+len(line) > max {
+			if _, err = conn.Write(buf.Bytes()); err != nil {
+				return err
+			}
+			buf.Reset()
+		}
+		buf.WriteString(line)
+	}
+	if buf.Len() > 0 {
+		_, err = conn.Write(buf.Bytes())
+	}
+	return err
+}
+
 var DefaultRegistry *Registry = NewRegistry(DEFAULT_RATE_UPDATE_INTERVAL)
@@ -0,0 +1,145 @@
+// Copyright (c) 2012 VMware, Inc.
+
+package gonatsd_test
+
+import (
+	"bufio"
+	. "gonatsd/gonatsd"
+	. "launchpad.net/gocheck"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+type MetricsSuite struct{}
+
+var _ = Suite(&MetricsSuite{})
+
+func newTestPushRegistry(count *int64) *Registry {
+	registry := NewRegistry(DEFAULT_RATE_UPDATE_INTERVAL)
+	registry.NewCounter("msg_recv", count)
+	registry.NewGauge("conns", func() string { return "3" })
+	registry.NewGauge("broken", func() string { return "N/A" })
+	registry.NewStringVal("info.arch", "amd64")
+	return registry
+}
+
+func sortedLines(data string) []string {
+	lines := strings.Split(strings.TrimSpace(data), "\n")
+	sort.Strings(lines)
+	return lines
+}
+
+func (s *MetricsSuite) TestPushStatsD(c *C) {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer listener.Close()
+	listener.SetReadDeadline(time.Now().Add(time.Second))
+
+	count := int64(5)
+	config := &MetricsPushConfig{Protocol: PUSH_STATSD, Address: listener.LocalAddr().String(),
+		Prefix: "test", IntervalDuration: time.Second}
+	pusher := NewPusher(newTestPushRegistry(&count), config)
+	buf := make([]byte, MAX_STATSD_PACKET)
+
+	c.Assert(pusher.Push(time.Now()), IsNil)
+	n, _, err := listener.ReadFrom(buf)
+	c.Assert(err, IsNil)
+	c.Check(sortedLines(string(buf[:n])), DeepEquals, []string{"test.conns:3|g", "test.msg_recv:5|c"})
+
+	// Counters are sent as increments
+	count = 12
+	c.Assert(pusher.Push(time.Now()), IsNil)
+	n, _, err = listener.ReadFrom(buf)
+	c.Assert(err, IsNil)
+	c.Check(sortedLines(string(buf[:n])), DeepEquals, []string{"test.conns:3|g", "test.msg_recv:7|c"})
+}
+
+func (s *MetricsSuite) TestPushGraphite(c *C) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer listener.Close()
+
+	count := int64(5)
+	config := &MetricsPushConfig{Protocol: PUSH_GRAPHITE, Address: listener.Addr().String(),
+		Prefix: "test", IntervalDuration: time.Second}
+	pusher := NewPusher(newTestPushRegistry(&count), config)
+
+	received := make(chan []string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			received <- nil
+			return
+		}
+		lines := make([]string, 0)
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+		}
+		sort.Strings(lines)
+		received <- lines
+	}()
+
+	now := time.Unix(1350000000, 0)
+	c.Assert(pusher.Push(now), IsNil)
+	c.Check(<-received, DeepEquals, []string{"test.conns 3 1350000000", "test.msg_recv 5 1350000000"})
+}
+
+func (s *MetricsSuite) TestHistogram(c *C) {
+	histogram := NewHistogram(10 * time.Second)
+	c.Check(*histogram.Snapshot(), DeepEquals, HistogramSnapshot{})
+
+	for i := int64(1); i <= 100; i++ {
+		histogram.Observe(i)
+	}
+	c.Check(*histogram.Snapshot(), DeepEquals, HistogramSnapshot{Count: 100, P50: 50, P90: 90, P99: 99, Max: 100})
+	c.Check(histogram.String(), Equals, "count=100 p50=50 p90=90 p99=99 max=100")
+
+	// The window spans two buckets
+	histogram.Rotate()
+	histogram.Observe(1000)
+	c.Check(histogram.Snapshot().Count, Equals, int64(101))
+	c.Check(histogram.Snapshot().Max, Equals, int64(1000))
+
+	histogram.Rotate()
+	c.Check(*histogram.Snapshot(), DeepEquals, HistogramSnapshot{Count: 1, P50: 1000, P90: 1000, P99: 1000, Max: 1000})
+
+	count, sum := histogram.Totals()
+	c.Check(count, Equals, int64(101))
+	c.Check(sum, Equals, int64(6050))
+}
+
+func (s *MetricsSuite) TestHistogramSampling(c *C) {
+	histogram := NewHistogram(10 * time.Second)
+	for i := int64(0); i < 10*MAX_HISTOGRAM_SAMPLES; i++ {
+		histogram.Observe(i % 100)
+	}
+	snapshot := histogram.Snapshot()
+	c.Check(snapshot.Count, Equals, int64(10*MAX_HISTOGRAM_SAMPLES))
+	c.Check(snapshot.Max, Equals, int64(99))
+	c.Check(snapshot.P50 > 40 && snapshot.P50 < 60, Equals, true, Commentf("p50: %d", snapshot.P50))
+}
+
+func (s *MetricsSuite) TestPushHistogram(c *C) {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer listener.Close()
+	listener.SetReadDeadline(time.Now().Add(time.Second))
+
+	registry := NewRegistry(DEFAULT_RATE_UPDATE_INTERVAL)
+	histogram := NewHistogram(DEFAULT_HISTOGRAM_WINDOW)
+	histogram.Observe(7)
+	registry.AddHistogram("latency", histogram)
+
+	config := &MetricsPushConfig{Protocol: PUSH_STATSD, Address: listener.LocalAddr().String(),
+		IntervalDuration: time.Second}
+	c.Assert(NewPusher(registry, config).Push(time.Now()), IsNil)
+
+	buf := make([]byte, MAX_STATSD_PACKET)
+	n, _, err := listener.ReadFrom(buf)
+	c.Assert(err, IsNil)
+	c.Check(sortedLines(string(buf[:n])), DeepEquals, []string{"latency.max:7|g", "latency.p50:7|g",
+		"latency.p90:7|g", "latency.p99:7|g"})
+}
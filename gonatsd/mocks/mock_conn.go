@@ -7,6 +7,7 @@ import (
 	gomock "code.google.com/p/gomock/gomock"
 	net "net"
 	gonatsd "gonatsd/gonatsd"
+	x509 "crypto/x509"
 )
 
 // Mock of Conn interface
@@ -30,6 +31,36 @@ func (_m *MockConn) EXPECT() *_MockConnRecorder {
 	return _m.recorder
 }
 
+func (_m *MockConn) Account() *gonatsd.Account {
+	ret := _m.ctrl.Call(_m, "Account")
+	ret0, _ := ret[0].(*gonatsd.Account)
+	return ret0
+}
+
+func (_mr *_MockConnRecorder) Account() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Account")
+}
+
+func (_m *MockConn) AuthHelper() *gonatsd.AuthHelper {
+	ret := _m.ctrl.Call(_m, "AuthHelper")
+	ret0, _ := ret[0].(*gonatsd.AuthHelper)
+	return ret0
+}
+
+func (_mr *_MockConnRecorder) AuthHelper() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "AuthHelper")
+}
+
+func (_m *MockConn) Client() *gonatsd.ClientInfo {
+	ret := _m.ctrl.Call(_m, "Client")
+	ret0, _ := ret[0].(*gonatsd.ClientInfo)
+	return ret0
+}
+
+func (_mr *_MockConnRecorder) Client() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Client")
+}
+
 func (_m *MockConn) Close() {
 	_m.ctrl.Call(_m, "Close")
 }
@@ -56,6 +87,16 @@ func (_mr *_MockConnRecorder) Closed() *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "Closed")
 }
 
+func (_m *MockConn) ConnInfo() *gonatsd.ConnInfo {
+	ret := _m.ctrl.Call(_m, "ConnInfo")
+	ret0, _ := ret[0].(*gonatsd.ConnInfo)
+	return ret0
+}
+
+func (_mr *_MockConnRecorder) ConnInfo() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "ConnInfo")
+}
+
 func (_m *MockConn) HeartbeatHelper() gonatsd.HeartbeatHelper {
 	ret := _m.ctrl.Call(_m, "HeartbeatHelper")
 	ret0, _ := ret[0].(gonatsd.HeartbeatHelper)
@@ -66,6 +107,16 @@ func (_mr *_MockConnRecorder) HeartbeatHelper() *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "HeartbeatHelper")
 }
 
+func (_m *MockConn) Id() uint64 {
+	ret := _m.ctrl.Call(_m, "Id")
+	ret0, _ := ret[0].(uint64)
+	return ret0
+}
+
+func (_mr *_MockConnRecorder) Id() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Id")
+}
+
 func (_m *MockConn) Options() *gonatsd.ConnOptions {
 	ret := _m.ctrl.Call(_m, "Options")
 	ret0, _ := ret[0].(*gonatsd.ConnOptions)
@@ -76,6 +127,26 @@ func (_mr *_MockConnRecorder) Options() *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "Options")
 }
 
+func (_m *MockConn) PeerCertificates() []*x509.Certificate {
+	ret := _m.ctrl.Call(_m, "PeerCertificates")
+	ret0, _ := ret[0].([]*x509.Certificate)
+	return ret0
+}
+
+func (_mr *_MockConnRecorder) PeerCertificates() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "PeerCertificates")
+}
+
+func (_m *MockConn) Pending() int {
+	ret := _m.ctrl.Call(_m, "Pending")
+	ret0, _ := ret[0].(int)
+	return ret0
+}
+
+func (_mr *_MockConnRecorder) Pending() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Pending")
+}
+
 func (_m *MockConn) Read(_param0 []byte) (int, error) {
 	ret := _m.ctrl.Call(_m, "Read", _param0)
 	ret0, _ := ret[0].(int)
@@ -108,6 +179,16 @@ func (_mr *_MockConnRecorder) RemoteAddr() *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "RemoteAddr")
 }
 
+func (_m *MockConn) Route() *gonatsd.Route {
+	ret := _m.ctrl.Call(_m, "Route")
+	ret0, _ := ret[0].(*gonatsd.Route)
+	return ret0
+}
+
+func (_mr *_MockConnRecorder) Route() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Route")
+}
+
 func (_m *MockConn) SendServerCmd(_param0 gonatsd.ServerCmd) {
 	_m.ctrl.Call(_m, "SendServerCmd", _param0)
 }
@@ -168,6 +249,16 @@ func (_mr *_MockConnRecorder) Subscriptions() *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "Subscriptions")
 }
 
+func (_m *MockConn) TryServeCommand(_param0 gonatsd.ClientCmd) bool {
+	ret := _m.ctrl.Call(_m, "TryServeCommand", _param0)
+	ret0, _ := ret[0].(bool)
+	return ret0
+}
+
+func (_mr *_MockConnRecorder) TryServeCommand(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "TryServeCommand", arg0)
+}
+
 func (_m *MockConn) Write(_param0 *gonatsd.Response) {
 	_m.ctrl.Call(_m, "Write", _param0)
 }
@@ -29,6 +29,16 @@ func (_m *MockHeartbeatHelper) EXPECT() *_MockHeartbeatHelperRecorder {
 	return _m.recorder
 }
 
+func (_m *MockHeartbeatHelper) Outstanding() int {
+	ret := _m.ctrl.Call(_m, "Outstanding")
+	ret0, _ := ret[0].(int)
+	return ret0
+}
+
+func (_mr *_MockHeartbeatHelperRecorder) Outstanding() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Outstanding")
+}
+
 func (_m *MockHeartbeatHelper) Ping() {
 	_m.ctrl.Call(_m, "Ping")
 }
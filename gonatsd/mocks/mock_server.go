@@ -6,6 +6,7 @@ package mocks
 import (
 	gomock "code.google.com/p/gomock/gomock"
 	gonatsd "gonatsd/gonatsd"
+	time "time"
 )
 
 // Mock of Server interface
@@ -29,6 +30,26 @@ func (_m *MockServer) EXPECT() *_MockServerRecorder {
 	return _m.recorder
 }
 
+func (_m *MockServer) Account(_param0 string) *gonatsd.Account {
+	ret := _m.ctrl.Call(_m, "Account", _param0)
+	ret0, _ := ret[0].(*gonatsd.Account)
+	return ret0
+}
+
+func (_mr *_MockServerRecorder) Account(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Account", arg0)
+}
+
+func (_m *MockServer) Cluster() *gonatsd.Cluster {
+	ret := _m.ctrl.Call(_m, "Cluster")
+	ret0, _ := ret[0].(*gonatsd.Cluster)
+	return ret0
+}
+
+func (_mr *_MockServerRecorder) Cluster() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Cluster")
+}
+
 func (_m *MockServer) Commands() chan<- gonatsd.ServerCmd {
 	ret := _m.ctrl.Call(_m, "Commands")
 	ret0, _ := ret[0].(chan<- gonatsd.ServerCmd)
@@ -67,6 +88,40 @@ func (_mr *_MockServerRecorder) Info() *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "Info")
 }
 
+func (_m *MockServer) LameDuck(_param0 time.Duration) {
+	_m.ctrl.Call(_m, "LameDuck", _param0)
+}
+
+func (_mr *_MockServerRecorder) LameDuck(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "LameDuck", arg0)
+}
+
+func (_m *MockServer) RegisterUser(_param0 gonatsd.Conn, _param1 string) bool {
+	ret := _m.ctrl.Call(_m, "RegisterUser", _param0, _param1)
+	ret0, _ := ret[0].(bool)
+	return ret0
+}
+
+func (_mr *_MockServerRecorder) RegisterUser(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "RegisterUser", arg0, arg1)
+}
+
+func (_m *MockServer) Reload(_param0 *gonatsd.Config) {
+	_m.ctrl.Call(_m, "Reload", _param0)
+}
+
+func (_mr *_MockServerRecorder) Reload(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Reload", arg0)
+}
+
+func (_m *MockServer) Shutdown(_param0 time.Duration) {
+	_m.ctrl.Call(_m, "Shutdown", _param0)
+}
+
+func (_mr *_MockServerRecorder) Shutdown(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Shutdown", arg0)
+}
+
 func (_m *MockServer) Start() {
 	_m.ctrl.Call(_m, "Start")
 }
@@ -85,12 +140,10 @@ func (_mr *_MockServerRecorder) Stats() *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "Stats")
 }
 
-func (_m *MockServer) Subscriptions() *gonatsd.Trie {
-	ret := _m.ctrl.Call(_m, "Subscriptions")
-	ret0, _ := ret[0].(*gonatsd.Trie)
-	return ret0
+func (_m *MockServer) UpdateInfo(_param0 func(*gonatsd.Info)) {
+	_m.ctrl.Call(_m, "UpdateInfo", _param0)
 }
 
-func (_mr *_MockServerRecorder) Subscriptions() *gomock.Call {
-	return _mr.mock.ctrl.RecordCall(_mr.mock, "Subscriptions")
+func (_mr *_MockServerRecorder) UpdateInfo(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "UpdateInfo", arg0)
 }
@@ -0,0 +1,51 @@
+// Copyright (c) 2012 VMware, Inc.
+
+package gonatsd
+
+import (
+	"crypto/subtle"
+	"golang.org/x/crypto/bcrypt"
+	"strings"
+)
+
+const (
+	DEFAULT_BCRYPT_COST = bcrypt.DefaultCost
+	// Compared against for unknown users, so they take as long to reject as
+	// a wrong password.
+	DUMMY_PASSWORD_HASH = "$2a$10$Xmia0YKjsH8WxXG/XEqjyOPqT4DTdDLDZNdkOIR6Ybj49D5cJ0tEe"
+)
+
+// Returns true iff the configured password is a bcrypt hash rather than
+// plain text.
+func IsPasswordHash(password string) bool {
+	return strings.HasPrefix(password, "$2a$") || strings.HasPrefix(password, "$2b$") ||
+		strings.HasPrefix(password, "$2y$")
+}
+
+// Returns true iff the password matches the configured one, which is either
+// a bcrypt hash or plain text. Plain text is compared in constant time.
+func PasswordMatches(configured, password string) bool {
+	if IsPasswordHash(configured) {
+		return bcrypt.CompareHashAndPassword([]byte(configured), []byte(password)) == nil
+	}
+	return subtle.ConstantTimeCompare([]byte(configured), []byte(password)) == 1
+}
+
+// Hash the password with bcrypt for use in the config.
+func HashPassword(password string, cost int) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), cost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// Returns an error if the configured password looks like a hash but can't
+// be used as one.
+func checkPasswordHash(password string) error {
+	if IsPasswordHash(password) {
+		_, err := bcrypt.Cost([]byte(password))
+		return err
+	}
+	return nil
+}
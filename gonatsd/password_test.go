@@ -0,0 +1,27 @@
+// Copyright (c) 2012 VMware, Inc.
+
+package gonatsd_test
+
+import (
+	. "gonatsd/gonatsd"
+	. "launchpad.net/gocheck"
+)
+
+type PasswordSuite struct{}
+
+var _ = Suite(&PasswordSuite{})
+
+func (s *PasswordSuite) TestHash(c *C) {
+	hash, err := HashPassword("secret", 4)
+	c.Assert(err, IsNil)
+	c.Check(IsPasswordHash(hash), Equals, true)
+	c.Check(PasswordMatches(hash, "secret"), Equals, true)
+	c.Check(PasswordMatches(hash, "wrong"), Equals, false)
+}
+
+func (s *PasswordSuite) TestPlain(c *C) {
+	c.Check(IsPasswordHash("secret"), Equals, false)
+	c.Check(PasswordMatches("secret", "secret"), Equals, true)
+	c.Check(PasswordMatches("secret", "secre"), Equals, false)
+	c.Check(PasswordMatches("secret", ""), Equals, false)
+}
@@ -0,0 +1,130 @@
+// Copyright (c) 2012 VMware, Inc.
+
+package gonatsd
+
+import (
+	"fmt"
+)
+
+// Subject permissions compiled from the allow and deny patterns.
+// A subject is allowed iff the allow list is empty or covers it, and no deny
+// pattern matches any subject it could stand for.
+type SubjectPermissions struct {
+	allow *Trie
+	deny  *Trie
+}
+
+// Publish and subscribe permissions of a user.
+type Permissions struct {
+	Publish   *SubjectPermissions
+	Subscribe *SubjectPermissions
+}
+
+// Compile the permissions config of a user.
+func NewPermissions(config *PermissionsConfig) (*Permissions, error) {
+	publish, err := NewSubjectPermissions(&config.Publish)
+	if err != nil {
+		return nil, fmt.Errorf("publish %s", err.Error())
+	}
+
+	subscribe, err := NewSubjectPermissions(&config.Subscribe)
+	if err != nil {
+		return nil, fmt.Errorf("subscribe %s", err.Error())
+	}
+
+	return &Permissions{publish, subscribe}, nil
+}
+
+// Compile the allow and deny subject patterns.
+func NewSubjectPermissions(config *SubjectPermissionsConfig) (*SubjectPermissions, error) {
+	p := &SubjectPermissions{}
+
+	if len(config.Allow) > 0 {
+		p.allow = NewTrie(".")
+		for _, pattern := range config.Allow {
+			if !ensureValidSubscribedSubject(pattern) {
+				return nil, fmt.Errorf("invalid allow pattern '%s'", pattern)
+			}
+			p.allow.Insert(pattern, true)
+		}
+	}
+
+	if len(config.Deny) > 0 {
+		p.deny = NewTrie(".")
+		for _, pattern := range config.Deny {
+			if !ensureValidSubscribedSubject(pattern) {
+				return nil, fmt.Errorf("invalid deny pattern '%s'", pattern)
+			}
+			p.deny.Insert(pattern, true)
+		}
+	}
+
+	return p, nil
+}
+
+// Returns true iff the subject, which may contain wildcards when
+// subscribing, is allowed.
+func (p *SubjectPermissions) Allowed(subject string) bool {
+	if p.allow != nil && len(p.allow.Match(subject, CoveringMatcher)) == 0 {
+		return false
+	}
+	if p.deny != nil && len(p.deny.Match(subject, OverlappingMatcher)) > 0 {
+		return false
+	}
+	return true
+}
+
+// Matches the patterns that cover every subject the token can stand for, so
+// a "*" token only matches "*" and ">" patterns and a ">" token only matches
+// ">" patterns.
+var CoveringMatcher = func(node *trieNode, token string) ([]*trieNode, []*trieNode) {
+	switch token {
+	case ">":
+		match := node.Children[">"]
+		if match != nil {
+			return emptyNodeSlice, []*trieNode{match}
+		}
+		return emptyNodeSlice, nil
+	case "*":
+		matches := make([]*trieNode, 0, 1)
+		match := node.Children["*"]
+		if match != nil {
+			matches = append(matches, match)
+		}
+		match = node.Children[">"]
+		if match != nil {
+			return matches, []*trieNode{match}
+		}
+		return matches, nil
+	}
+	return WildcardMatcher(node, token)
+}
+
+// Matches the patterns that share at least one subject with the token, so
+// a "*" token matches every pattern token and a ">" token matches every
+// longer pattern.
+var OverlappingMatcher = func(node *trieNode, token string) ([]*trieNode, []*trieNode) {
+	switch token {
+	case ">":
+		return emptyNodeSlice, descendants(node, make([]*trieNode, 0, len(node.Children)))
+	case "*":
+		matches := make([]*trieNode, 0, len(node.Children))
+		for _, child := range node.Children {
+			matches = append(matches, child)
+		}
+		match := node.Children[">"]
+		if match != nil {
+			return matches, []*trieNode{match}
+		}
+		return matches, nil
+	}
+	return WildcardMatcher(node, token)
+}
+
+func descendants(node *trieNode, result []*trieNode) []*trieNode {
+	for _, child := range node.Children {
+		result = append(result, child)
+		result = descendants(child, result)
+	}
+	return result
+}
@@ -0,0 +1,67 @@
+// Copyright (c) 2012 VMware, Inc.
+
+package gonatsd_test
+
+import (
+	. "gonatsd/gonatsd"
+	. "launchpad.net/gocheck"
+)
+
+type PermissionsSuite struct{}
+
+var _ = Suite(&PermissionsSuite{})
+
+func newSubjectPermissions(c *C, allow, deny []string) *SubjectPermissions {
+	p, err := NewSubjectPermissions(&SubjectPermissionsConfig{Allow: allow, Deny: deny})
+	c.Assert(err, IsNil)
+	return p
+}
+
+func (s *PermissionsSuite) TestEmpty(c *C) {
+	p := newSubjectPermissions(c, nil, nil)
+	c.Check(p.Allowed("foo"), Equals, true)
+	c.Check(p.Allowed(">"), Equals, true)
+}
+
+func (s *PermissionsSuite) TestAllow(c *C) {
+	p := newSubjectPermissions(c, []string{"foo.*", "bar.>", "baz"}, nil)
+	c.Check(p.Allowed("foo.a"), Equals, true)
+	c.Check(p.Allowed("foo.a.b"), Equals, false)
+	c.Check(p.Allowed("bar.a.b"), Equals, true)
+	c.Check(p.Allowed("bar"), Equals, false)
+	c.Check(p.Allowed("baz"), Equals, true)
+	c.Check(p.Allowed("qux"), Equals, false)
+}
+
+func (s *PermissionsSuite) TestAllowWildcardSubject(c *C) {
+	p := newSubjectPermissions(c, []string{"foo.*", "bar.>", "baz.a"}, nil)
+	c.Check(p.Allowed("foo.*"), Equals, true)
+	c.Check(p.Allowed("foo.>"), Equals, false)
+	c.Check(p.Allowed("bar.*"), Equals, true)
+	c.Check(p.Allowed("bar.>"), Equals, true)
+	c.Check(p.Allowed("baz.*"), Equals, false)
+	c.Check(p.Allowed(">"), Equals, false)
+}
+
+func (s *PermissionsSuite) TestDeny(c *C) {
+	p := newSubjectPermissions(c, nil, []string{"foo.secret", "bar.>"})
+	c.Check(p.Allowed("foo.public"), Equals, true)
+	c.Check(p.Allowed("foo.secret"), Equals, false)
+	c.Check(p.Allowed("bar"), Equals, true)
+	c.Check(p.Allowed("bar.a"), Equals, false)
+}
+
+func (s *PermissionsSuite) TestDenyWildcardSubject(c *C) {
+	p := newSubjectPermissions(c, []string{">"}, []string{"foo.secret.key"})
+	c.Check(p.Allowed("foo.*"), Equals, true)
+	c.Check(p.Allowed("foo.*.key"), Equals, false)
+	c.Check(p.Allowed("foo.>"), Equals, false)
+	c.Check(p.Allowed(">"), Equals, false)
+	c.Check(p.Allowed("bar.>"), Equals, true)
+}
+
+func (s *PermissionsSuite) TestInvalidPattern(c *C) {
+	_, err := NewPermissions(&PermissionsConfig{
+		Subscribe: SubjectPermissionsConfig{Deny: []string{"foo..bar"}}})
+	c.Check(err, ErrorMatches, "subscribe invalid deny pattern 'foo..bar'")
+}
@@ -0,0 +1,92 @@
+// Copyright (c) 2012 VMware, Inc.
+
+package gonatsd
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	PROMETHEUS_NAMESPACE    = "gnatsd"
+	PROMETHEUS_CONTENT_TYPE = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+// Turn a dotted metric name into a valid Prometheus name.
+func PrometheusName(name string) string {
+	sanitized := []byte(name)
+	for i, b := range sanitized {
+		if !(b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z' || b >= '0' && b <= '9' || b == '_') {
+			sanitized[i] = '_'
+		}
+	}
+	return PROMETHEUS_NAMESPACE + "_" + string(sanitized)
+}
+
+func prometheusLabelValue(value string) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, `"`, `\"`, -1)
+	return strings.Replace(value, "\n", `\n`, -1)
+}
+
+// Write the metrics in the Prometheus text format. Counters are exposed as
+// counters, gauges and rates as gauges, histograms as summaries, and string
+// values as the labels of a single info metric. Values that are not
+// numbers, like rates that haven't been sampled yet, are left out.
+func (r *Registry) WritePrometheus(w io.Writer) {
+	r.Metrics(func(metrics map[string]fmt.Stringer) {
+		names := make([]string, 0, len(metrics))
+		for name, _ := range metrics {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		labels := make([]string, 0)
+		for _, name := range names {
+			metric := metrics[name]
+			if _, ok := metric.(*StringVal); ok {
+				label := PrometheusName(strings.TrimPrefix(name, "info."))[len(PROMETHEUS_NAMESPACE)+1:]
+				labels = append(labels, fmt.Sprintf(`%s="%s"`, label, prometheusLabelValue(metric.String())))
+				continue
+			}
+
+			if histogram, ok := metric.(*Histogram); ok {
+				writePrometheusSummary(w, PrometheusName(name), histogram)
+				continue
+			}
+
+			value, err := strconv.ParseFloat(metric.String(), 64)
+			if err != nil {
+				continue
+			}
+
+			promName, promType := PrometheusName(name), "gauge"
+			if _, ok := metric.(*Counter); ok {
+				promName, promType = promName+"_total", "counter"
+			}
+			fmt.Fprintf(w, "# TYPE %s %s\n%s %s\n", promName, promType, promName,
+				strconv.FormatFloat(value, 'g', -1, 64))
+		}
+
+		if len(labels) > 0 {
+			promName := PrometheusName("info")
+			fmt.Fprintf(w, "# TYPE %s gauge\n%s{%s} 1\n", promName, promName, strings.Join(labels, ","))
+		}
+	})
+}
+
+// The quantiles are over the histogram window, the count and sum since it
+// was created. The max gets its own gauge.
+func writePrometheusSummary(w io.Writer, promName string, histogram *Histogram) {
+	snapshot := histogram.Snapshot()
+	count, sum := histogram.Totals()
+	fmt.Fprintf(w, "# TYPE %s summary\n", promName)
+	fmt.Fprintf(w, "%s{quantile=\"0.5\"} %d\n", promName, snapshot.P50)
+	fmt.Fprintf(w, "%s{quantile=\"0.9\"} %d\n", promName, snapshot.P90)
+	fmt.Fprintf(w, "%s{quantile=\"0.99\"} %d\n", promName, snapshot.P99)
+	fmt.Fprintf(w, "%s_sum %d\n%s_count %d\n", promName, sum, promName, count)
+	fmt.Fprintf(w, "# TYPE %s_max gauge\n%s_max %d\n", promName, promName, snapshot.Max)
+}
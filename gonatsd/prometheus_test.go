@@ -0,0 +1,62 @@
+// Copyright (c) 2012 VMware, Inc.
+
+package gonatsd_test
+
+import (
+	"bytes"
+	. "gonatsd/gonatsd"
+	. "launchpad.net/gocheck"
+	"time"
+)
+
+type PrometheusSuite struct{}
+
+var _ = Suite(&PrometheusSuite{})
+
+func (s *PrometheusSuite) TestPrometheusName(c *C) {
+	c.Check(PrometheusName("msg_recv.rate.10s"), Equals, "gnatsd_msg_recv_rate_10s")
+	c.Check(PrometheusName("ops.pub"), Equals, "gnatsd_ops_pub")
+	c.Check(PrometheusName("a-b:c"), Equals, "gnatsd_a_b_c")
+}
+
+func (s *PrometheusSuite) TestWritePrometheus(c *C) {
+	registry := NewRegistry(DEFAULT_RATE_UPDATE_INTERVAL)
+	count := int64(42)
+	registry.NewCounter("ops.pub", &count)
+	registry.NewGauge("runtime.goroutines", func() string { return "7" })
+	registry.NewGauge("broken", func() string { return "N/A" })
+	registry.NewRate("msg_recv.rate.10s", &count, 10*time.Second)
+	registry.NewStringVal("info.arch", "amd64")
+	registry.NewStringVal("info.cmdline", `gnatsd -config "a b.yml"`)
+	registry.NewStringVal("accounts", "1")
+
+	out := &bytes.Buffer{}
+	registry.WritePrometheus(out)
+	c.Check(out.String(), Equals, `# TYPE gnatsd_ops_pub_total counter
+gnatsd_ops_pub_total 42
+# TYPE gnatsd_runtime_goroutines gauge
+gnatsd_runtime_goroutines 7
+# TYPE gnatsd_info gauge
+gnatsd_info{accounts="1",arch="amd64",cmdline="gnatsd -config \"a b.yml\""} 1
+`)
+}
+
+func (s *PrometheusSuite) TestWritePrometheusSummary(c *C) {
+	registry := NewRegistry(DEFAULT_RATE_UPDATE_INTERVAL)
+	histogram := NewHistogram(DEFAULT_HISTOGRAM_WINDOW)
+	histogram.Observe(10)
+	histogram.Observe(20)
+	registry.AddHistogram("latency.publish_us", histogram)
+
+	out := &bytes.Buffer{}
+	registry.WritePrometheus(out)
+	c.Check(out.String(), Equals, `# TYPE gnatsd_latency_publish_us summary
+gnatsd_latency_publish_us{quantile="0.5"} 10
+gnatsd_latency_publish_us{quantile="0.9"} 20
+gnatsd_latency_publish_us{quantile="0.99"} 20
+gnatsd_latency_publish_us_sum 30
+gnatsd_latency_publish_us_count 2
+# TYPE gnatsd_latency_publish_us_max gauge
+gnatsd_latency_publish_us_max 20
+`)
+}
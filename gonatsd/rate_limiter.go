@@ -0,0 +1,106 @@
+// Copyright (c) 2012 VMware, Inc.
+
+package gonatsd
+
+import (
+	"time"
+)
+
+// What happens to a publish over the rate limits.
+const (
+	PUBLISH_THROTTLE = "throttle" // stop reading from the client until it's allowed
+	PUBLISH_ERROR    = "error"    // drop it and send an error to the client
+)
+
+// A TokenBucket refills at the rate per second up to one second worth of
+// tokens. A full bucket always lets one take through, so takes larger than
+// the rate are possible and leave it in debt.
+type TokenBucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// Create a full token bucket.
+func NewTokenBucket(rate int, now time.Time) *TokenBucket {
+	return &TokenBucket{rate: float64(rate), tokens: float64(rate), last: now}
+}
+
+func (b *TokenBucket) refill(now time.Time) {
+	if now.After(b.last) {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.rate {
+			b.tokens = b.rate
+		}
+		b.last = now
+	}
+}
+
+// Returns true iff n tokens can be taken now.
+func (b *TokenBucket) Allows(n int, now time.Time) bool {
+	b.refill(now)
+	return b.tokens >= float64(n) || b.tokens >= b.rate
+}
+
+// Take n tokens, going into debt if there are not enough of them.
+// Returns how long to wait until the debt is paid off.
+func (b *TokenBucket) Take(n int, now time.Time) time.Duration {
+	b.refill(now)
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// A RateLimiter limits the messages and bytes published per second by a
+// connection. It must only be used from the read loop.
+type RateLimiter struct {
+	messages *TokenBucket
+	bytes    *TokenBucket
+}
+
+// Create a rate limiter, returns nil if nothing is limited.
+func NewRateLimiter(config *PublishLimitsConfig, now time.Time) *RateLimiter {
+	if config.Messages <= 0 && config.Bytes <= 0 {
+		return nil
+	}
+
+	l := &RateLimiter{}
+	if config.Messages > 0 {
+		l.messages = NewTokenBucket(config.Messages, now)
+	}
+	if config.Bytes > 0 {
+		l.bytes = NewTokenBucket(config.Bytes, now)
+	}
+	return l
+}
+
+// Returns true iff a message of the size can be published now, in which
+// case it's accounted for.
+func (l *RateLimiter) Allow(size int, now time.Time) bool {
+	if l.messages != nil && !l.messages.Allows(1, now) {
+		return false
+	}
+	if l.bytes != nil && !l.bytes.Allows(size, now) {
+		return false
+	}
+	l.Wait(size, now)
+	return true
+}
+
+// Account for a message of the size.
+// Returns how long to wait before reading the next one.
+func (l *RateLimiter) Wait(size int, now time.Time) time.Duration {
+	var wait time.Duration
+	if l.messages != nil {
+		wait = l.messages.Take(1, now)
+	}
+	if l.bytes != nil {
+		bytesWait := l.bytes.Take(size, now)
+		if bytesWait > wait {
+			wait = bytesWait
+		}
+	}
+	return wait
+}
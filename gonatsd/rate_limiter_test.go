@@ -0,0 +1,77 @@
+// Copyright (c) 2012 VMware, Inc.
+
+package gonatsd_test
+
+import (
+	. "gonatsd/gonatsd"
+	. "launchpad.net/gocheck"
+	"time"
+)
+
+type RateLimiterSuite struct{}
+
+var _ = Suite(&RateLimiterSuite{})
+
+func (s *RateLimiterSuite) TestTokenBucket(c *C) {
+	now := time.Now()
+	bucket := NewTokenBucket(10, now)
+
+	c.Check(bucket.Allows(10, now), Equals, true)
+	c.Check(bucket.Take(5, now), Equals, time.Duration(0))
+	c.Check(bucket.Allows(6, now), Equals, false)
+	c.Check(bucket.Take(10, now), Equals, 500*time.Millisecond)
+
+	// Refills at the rate, up to one second worth
+	now = now.Add(time.Second)
+	c.Check(bucket.Allows(6, now), Equals, false)
+	c.Check(bucket.Allows(5, now), Equals, true)
+	now = now.Add(time.Hour)
+	c.Check(bucket.Take(10, now), Equals, time.Duration(0))
+	c.Check(bucket.Allows(1, now), Equals, false)
+}
+
+func (s *RateLimiterSuite) TestTokenBucketFull(c *C) {
+	now := time.Now()
+	bucket := NewTokenBucket(10, now)
+
+	c.Check(bucket.Allows(100, now), Equals, true)
+	c.Check(bucket.Take(100, now), Equals, 9*time.Second)
+	c.Check(bucket.Allows(1, now.Add(time.Second)), Equals, false)
+}
+
+func (s *RateLimiterSuite) TestNewRateLimiter(c *C) {
+	c.Check(NewRateLimiter(&PublishLimitsConfig{}, time.Now()), IsNil)
+	c.Check(NewRateLimiter(&PublishLimitsConfig{Messages: 1}, time.Now()), NotNil)
+	c.Check(NewRateLimiter(&PublishLimitsConfig{Bytes: 1}, time.Now()), NotNil)
+}
+
+func (s *RateLimiterSuite) TestAllow(c *C) {
+	now := time.Now()
+	limiter := NewRateLimiter(&PublishLimitsConfig{Messages: 2, Bytes: 100}, now)
+
+	c.Check(limiter.Allow(60, now), Equals, true)
+	c.Check(limiter.Allow(60, now), Equals, false) // bytes
+	c.Check(limiter.Allow(40, now), Equals, true)
+	c.Check(limiter.Allow(0, now), Equals, false) // messages
+	c.Check(limiter.Allow(0, now.Add(time.Second)), Equals, true)
+}
+
+func (s *RateLimiterSuite) TestWait(c *C) {
+	now := time.Now()
+	limiter := NewRateLimiter(&PublishLimitsConfig{Messages: 10, Bytes: 100}, now)
+
+	for i := 0; i < 10; i++ {
+		c.Check(limiter.Wait(1, now), Equals, time.Duration(0))
+	}
+	c.Check(limiter.Wait(1, now), Equals, 100*time.Millisecond)
+	c.Check(limiter.Wait(200, now), Equals, 1110*time.Millisecond)
+}
+
+func (s *ConfigSuite) TestPublishLimits(c *C) {
+	limits := &LimitsConfig{Publish: PublishLimitsConfig{Messages: 10}}
+	limits.PublishUsers = map[string]PublishLimitsConfig{"foo": PublishLimitsConfig{Bytes: 10}}
+
+	c.Check(limits.PublishLimits(""), DeepEquals, &PublishLimitsConfig{Messages: 10})
+	c.Check(limits.PublishLimits("bar"), DeepEquals, &PublishLimitsConfig{Messages: 10})
+	c.Check(limits.PublishLimits("foo"), DeepEquals, &PublishLimitsConfig{Bytes: 10})
+}
@@ -5,12 +5,16 @@ package gonatsd
 import (
 	"encoding/json"
 	"io"
+	"strings"
+	"sync/atomic"
+	"time"
 	"unicode"
 )
 
 // Map of all request parsers.
 var REQUEST_PARSERS = map[string]func(Conn, string) (Request, error){
 	PUB:     ParsePublishRequest,
+	HPUB:    ParseHeaderPublishRequest,
 	SUB:     ParseSubscriptionRequest,
 	UNSUB:   ParseUnsubscriptionRequest,
 	PING:    ParsePingRequest,
@@ -87,7 +91,22 @@ func ParseInfoRequest(c Conn, args string) (Request, error) {
 var INFO_PRELUDE = "INFO "
 
 func (r *InfoRequest) Serve(c Conn) *Response {
-	return &Response{Value: &INFO_PRELUDE, Bytes: c.Server().Info()}
+	info := c.Server().Info()
+	if nonce := c.AuthHelper().Nonce(); len(nonce) > 0 && len(*info) > 0 {
+		info = withNonce(info, nonce)
+	}
+	return &Response{Value: &INFO_PRELUDE, Bytes: info}
+}
+
+// Adds the connection nonce to the shared INFO object. The nonce is base64
+// encoded, so it doesn't need escaping.
+func withNonce(info *[]byte, nonce string) *[]byte {
+	result := make([]byte, 0, len(*info)+len(nonce)+12)
+	result = append(result, `{"nonce":"`...)
+	result = append(result, nonce...)
+	result = append(result, `",`...)
+	result = append(result, (*info)[1:]...)
+	return &result
 }
 
 func (r *InfoRequest) Dispatch(c Conn) {
@@ -124,12 +143,110 @@ func ParsePublishRequest(c Conn, args string) (Request, error) {
 		return nil, ErrUnknownOp
 	}
 
+	message.Content, err = readPayload(c, length)
+	if err != nil {
+		return nil, err
+	}
+	return newPublishRequest(c, message)
+}
+
+// Parses a publish request with headers, whose size counts against the
+// payload limit: HPUB <subject> [reply] <header size> <total size>
+func ParseHeaderPublishRequest(c Conn, args string) (Request, error) {
+	message := &Message{}
+	var headerLength, length int
+	var err error
+
+	fields := fieldsN(args, unicode.IsSpace, 4)
+
+	switch len(fields) {
+	case 3:
+		message.Subject = fields[0]
+	case 4:
+		message.Subject = fields[0]
+		message.ReplyTo = fields[1]
+	default:
+		return nil, ErrUnknownOp
+	}
+	headerLength, length, err = parseHeaderLengths(fields[len(fields)-2:])
+	if err != nil {
+		return nil, err
+	}
+
+	message.Content, message.Header, err = readHeaderPayload(c, headerLength, length)
+	if err != nil {
+		return nil, err
+	}
+	return newPublishRequest(c, message)
+}
+
+// Checks the message against the subject rules, limits and permissions.
+func newPublishRequest(c Conn, message *Message) (Request, error) {
+	if c.Options().Pedantic && !ensureValidPublishedSubject(message.Subject) {
+		return nil, ErrInvalidSubject
+	}
+
+	err := checkSubjectLimits(c, message.Subject)
+	if err != nil {
+		return nil, err
+	}
+
+	permissions := c.AuthHelper().Permissions()
+	if permissions != nil && !permissions.Publish.Allowed(message.Subject) {
+		Log.Debugf("[client %s] not allowed to publish to: %s", c.RemoteAddr(), message.Subject)
+		return nil, ErrPermissions
+	}
+	return &PublishRequest{message}, nil
+}
+
+func parseHeaderLengths(fields []string) (int, int, error) {
+	headerLength, err := parseInt(fields[0])
+	if err != nil {
+		return 0, 0, ErrUnknownOp
+	}
+	length, err := parseInt(fields[1])
+	if err != nil || headerLength < HEADER_MIN_LEN || headerLength > length {
+		return 0, 0, ErrUnknownOp
+	}
+	return headerLength, length, nil
+}
+
+// Reads a payload starting with a header block, returns the content after
+// the header block along with it.
+func readHeaderPayload(c Conn, headerLength, length int) ([]byte, *Header, error) {
+	payload, err := readPayload(c, length)
+	if err != nil {
+		return nil, nil, err
+	}
+	header, err := ParseHeader(payload[:headerLength])
+	if err != nil {
+		return nil, nil, ErrInvalidHeader
+	}
+	return payload[headerLength:], header, nil
+}
+
+// Returns an error if the subject is longer or has more tokens than allowed.
+func checkSubjectLimits(c Conn, subject string) error {
+	limits := &c.Server().Config().Limits
+	if limits.SubjectLength > 0 && len(subject) > limits.SubjectLength {
+		atomic.AddInt64(&c.Server().Stats().subject_length, 1)
+		return ErrSubjectTooLong
+	}
+	if limits.SubjectTokens > 0 && strings.Count(subject, ".")+1 > limits.SubjectTokens {
+		atomic.AddInt64(&c.Server().Stats().subject_tokens, 1)
+		return ErrSubjectTooDeep
+	}
+	return nil
+}
+
+// Reads a message payload of the given length followed by an empty control line.
+func readPayload(c Conn, length int) ([]byte, error) {
 	if length > c.Server().Config().Limits.Payload {
 		return nil, ErrPayloadTooBig
 	}
 
-	message.Content = make([]byte, length)
-	_, err = io.ReadFull(c, message.Content)
+	content := make([]byte, length)
+	_, err := io.ReadFull(c, content)
 	if err != nil {
 		return nil, err
 	}
@@ -142,11 +259,7 @@ func ParsePublishRequest(c Conn, args string) (Request, error) {
 	if l != "" {
 		return nil, ErrUnknownOp
 	}
-
-	if c.Options().Pedantic && !ensureValidPublishedSubject(message.Subject) {
-		return nil, ErrInvalidSubject
-	}
-	return &PublishRequest{message}, nil
+	return content, nil
 }
 
 func (r *PublishRequest) Serve(c Conn) *Response {
@@ -154,9 +267,10 @@ func (r *PublishRequest) Serve(c Conn) *Response {
 }
 
 func (r *PublishRequest) Dispatch(c Conn) {
-	c.Server().Commands() <- &PublishCmd{r.Message}
+	options := c.Options()
+	c.Server().Commands() <- &PublishCmd{r.Message, c.Account(), c, options.Echo, options.NoResponders, time.Now()}
 
-	if c.Options().Verbose {
+	if options.Verbose {
 		c.ServeRequest(r)
 	}
 }
@@ -164,10 +278,23 @@ func (r *PublishRequest) Dispatch(c Conn) {
 // A ConnectRequest represents a Request sent to authenticate (if needed) and 
 // negotiate any connection options.
 type ConnectRequest struct {
-	Verbose  *bool   `json:"verbose"`
-	Pedantic *bool   `json:"pedantic"`
-	User     *string `json:"user"`
-	Password *string `json:"pass"`
+	Verbose      *bool   `json:"verbose"`
+	Pedantic     *bool   `json:"pedantic"`
+	User         *string `json:"user"`
+	Password     *string `json:"pass"`
+	AuthToken    *string `json:"auth_token"`
+	PublicKey    *string `json:"public_key"`
+	Signature    *string `json:"sig"`
+	Headers      *bool   `json:"headers"`
+	NoResponders *bool   `json:"no_responders"` // requires headers
+	Echo         *bool   `json:"echo"`
+	Protocol     *int    `json:"protocol"`
+	Name         *string `json:"name"`
+	Lang         *string `json:"lang"`
+	Version      *string `json:"version"`
+
+	// Signaled once the dispatch loop authenticated the request.
+	Done chan bool `json:"-"`
 }
 
 func ParseConnectRequest(c Conn, args string) (Request, error) {
@@ -176,6 +303,10 @@ func ParseConnectRequest(c Conn, args string) (Request, error) {
 	if err != nil {
 		return nil, ErrInvalidConfig
 	}
+	if request.Protocol != nil && (*request.Protocol < PROTOCOL_ORIGINAL || *request.Protocol > MAX_PROTOCOL) {
+		return nil, ErrUnknownProtocol
+	}
+	request.Done = make(chan bool, 1)
 	return request, nil
 }
 
@@ -186,14 +317,43 @@ func (r *ConnectRequest) Serve(c Conn) *Response {
 	if r.Verbose != nil {
 		c.Options().Verbose = *r.Verbose
 	}
+	if r.Headers != nil {
+		c.Options().Headers = *r.Headers
+	}
+	if r.NoResponders != nil {
+		c.Options().NoResponders = *r.NoResponders && c.Options().Headers
+	}
+	if r.Echo != nil {
+		c.Options().Echo = *r.Echo
+	}
+	if r.Protocol != nil {
+		c.Options().Protocol = *r.Protocol
+	}
+
+	client := c.Client()
+	if r.Name != nil {
+		client.Name = *r.Name
+	}
+	if r.Lang != nil {
+		client.Lang = *r.Lang
+	}
+	if r.Version != nil {
+		client.Version = *r.Version
+	}
+	Log.Infof("[client %s] connect [name: %s] [lang: %s] [version: %s] [protocol: %d]", c.RemoteAddr(),
+		client.Name, client.Lang, client.Version, c.Options().Protocol)
+
 	if c.Options().Verbose {
 		return &Response{Value: &OK}
 	}
 	return nil
 }
 
+// Waits for authentication, so the requests parsed after it are checked
+// against the permissions of the user.
 func (r *ConnectRequest) Dispatch(c Conn) {
 	c.ServeRequest(r)
+	<-r.Done
 }
 
 // A BadRequest represents a "Request" that had a problem for which 
@@ -246,6 +406,11 @@ func ParseSubscriptionRequest(c Conn, args string) (Request, error) {
 		return nil, ErrInvalidSubject
 	}
 
+	err = checkSubjectLimits(c, subscription.Subject)
+	if err != nil {
+		return nil, err
+	}
+
 	return &SubscriptionRequest{subscription, make(chan bool, 1)}, nil
 }
 
@@ -255,6 +420,23 @@ func (r *SubscriptionRequest) Serve(c Conn) *Response {
 		return &Response{Value: &ErrInvalidSidTaken.Message}
 	}
 
+	permissions := c.AuthHelper().Permissions()
+	if permissions != nil && !permissions.Subscribe.Allowed(r.Subscription.Subject) {
+		Log.Debugf("[client %s] not allowed to subscribe to: %s", c.RemoteAddr(), r.Subscription.Subject)
+		r.Done <- true
+		return &Response{Value: &ErrPermissions.Message}
+	}
+
+	// Routes carry the subscriptions of a whole server.
+	limit := c.Server().Config().Limits.Subscriptions
+	if limit > 0 && len(c.Subscriptions()) >= limit && c.Route() == nil {
+		atomic.AddInt64(&c.Server().Stats().max_subs, 1)
+		r.Done <- true
+		return &Response{Value: &ErrMaxSubsExceeded.Message}
+	}
+
+	r.Subscription.Account = c.Account()
+	r.Subscription.Headers = c.Options().Headers
 	c.Subscriptions()[r.Subscription.Id] = r.Subscription
 	c.SendServerCmd(&SubscribeCmd{r.Subscription, r.Done})
 	if c.Options().Verbose {
@@ -326,6 +508,132 @@ func (r *UnsubscriptionRequest) Dispatch(c Conn) {
 	c.ServeRequest(r)
 }
 
+// A RouteInfoRequest represents the INFO sent by another server in the
+// cluster when a route is established.
+type RouteInfoRequest struct {
+	Info *Info
+}
+
+func ParseRouteInfoRequest(c Conn, args string) (Request, error) {
+	info := &Info{}
+	err := json.Unmarshal([]byte(args), info)
+	if err != nil || len(info.ServerId) == 0 {
+		return nil, ErrInvalidRouteInfo
+	}
+	return &RouteInfoRequest{info}, nil
+}
+
+func (r *RouteInfoRequest) Serve(c Conn) *Response {
+	c.Route().ServerId = r.Info.ServerId
+	c.Options().Headers = r.Info.Headers
+	cmd := &RegisterRouteCmd{Conn: c, Registered: make(chan bool, 1)}
+	c.SendServerCmd(cmd)
+	if !<-cmd.Registered {
+		c.CloseWithError(ErrDuplicateRoute)
+		return nil
+	}
+	for _, response := range cmd.Interest {
+		c.Write(response)
+	}
+	Log.Infof("[route %s] registered server: %s", c.RemoteAddr(), r.Info.ServerId)
+	return nil
+}
+
+func (r *RouteInfoRequest) Dispatch(c Conn) {
+	c.ServeRequest(r)
+}
+
+// A RoutedMessageRequest represents a message forwarded by another server in
+// the cluster to one of our subscriptions.
+type RoutedMessageRequest struct {
+	SubscriptionId int
+	Message        *Message
+}
+
+func ParseRoutedMessageRequest(c Conn, args string) (Request, error) {
+	request := &RoutedMessageRequest{Message: &Message{}}
+	var length int
+	var err error
+
+	fields := fieldsN(args, unicode.IsSpace, 4)
+
+	switch len(fields) {
+	case 3:
+		request.Message.Subject = fields[0]
+		request.SubscriptionId, err = parseInt(fields[1])
+		if err != nil {
+			return nil, ErrUnknownOp
+		}
+		length, err = parseInt(fields[2])
+		if err != nil {
+			return nil, ErrUnknownOp
+		}
+	case 4:
+		request.Message.Subject = fields[0]
+		request.SubscriptionId, err = parseInt(fields[1])
+		if err != nil {
+			return nil, ErrUnknownOp
+		}
+		request.Message.ReplyTo = fields[2]
+		length, err = parseInt(fields[3])
+		if err != nil {
+			return nil, ErrUnknownOp
+		}
+	default:
+		return nil, ErrUnknownOp
+	}
+
+	request.Message.Content, err = readPayload(c, length)
+	if err != nil {
+		return nil, err
+	}
+	return request, nil
+}
+
+// Parses a routed message with headers:
+// HMSG <subject> <sid> [reply] <header size> <total size>
+func ParseRoutedHeaderMessageRequest(c Conn, args string) (Request, error) {
+	request := &RoutedMessageRequest{Message: &Message{}}
+	var headerLength, length int
+	var err error
+
+	fields := fieldsN(args, unicode.IsSpace, 5)
+
+	switch len(fields) {
+	case 4:
+	case 5:
+		request.Message.ReplyTo = fields[2]
+	default:
+		return nil, ErrUnknownOp
+	}
+	request.Message.Subject = fields[0]
+	request.SubscriptionId, err = parseInt(fields[1])
+	if err != nil {
+		return nil, ErrUnknownOp
+	}
+	headerLength, length, err = parseHeaderLengths(fields[len(fields)-2:])
+	if err != nil {
+		return nil, err
+	}
+
+	request.Message.Content, request.Message.Header, err = readHeaderPayload(c, headerLength, length)
+	if err != nil {
+		return nil, err
+	}
+	return request, nil
+}
+
+// Routed messages go through the dispatch loop like the other requests, so
+// they're dropped along with the route if it hasn't authenticated.
+func (r *RoutedMessageRequest) Serve(c Conn) *Response {
+	c.SendServerCmd(&RoutedMessageCmd{r.SubscriptionId, r.Message})
+	return nil
+}
+
+func (r *RoutedMessageRequest) Dispatch(c Conn) {
+	c.ServeRequest(r)
+}
+
 var (
 	PING_REQUEST = &PingRequest{}
 	PONG_REQUEST = &PongRequest{}
@@ -8,6 +8,7 @@ import (
 	. "gonatsd/gonatsd/mocks"
 	"io"
 	. "launchpad.net/gocheck"
+	"net"
 	"time"
 )
 
@@ -131,12 +132,32 @@ func (s *RequestSuite) TestInfoServe(c *C) {
 	server := NewMockServer(ctrl)
 	server.EXPECT().Info().Return(&dummyInfo).AnyTimes()
 	conn.EXPECT().Server().Return(server).AnyTimes()
+	conn.EXPECT().AuthHelper().Return(NewAuthHelper(conn, &AuthConfig{})).AnyTimes()
 
 	req, _ := ParseInfoRequest(conn, "")
 	resp := req.Serve(conn)
 	c.Check(resp, DeepEquals, NewResponse("INFO ", dummyInfo))
 }
 
+func (s *RequestSuite) TestInfoServeNonce(c *C) {
+	ctrl := gomock.NewController(c)
+	defer ctrl.Finish()
+
+	info := []byte(`{"server_id":"a"}`)
+	conn := NewMockConn(ctrl)
+	server := NewMockServer(ctrl)
+	server.EXPECT().Info().Return(&info).AnyTimes()
+	conn.EXPECT().Server().Return(server).AnyTimes()
+	helper := NewAuthHelper(conn, &AuthConfig{PublicKeys: []string{"key"}})
+	defer helper.Stop()
+	conn.EXPECT().AuthHelper().Return(helper).AnyTimes()
+
+	req, _ := ParseInfoRequest(conn, "")
+	resp := req.Serve(conn)
+	c.Check(resp, DeepEquals, NewResponse("INFO ",
+		[]byte(`{"nonce":"`+helper.Nonce()+`","server_id":"a"}`)))
+}
+
 func (s *RequestSuite) TestInfoDispatch(c *C) {
 	ctrl := gomock.NewController(c)
 	defer ctrl.Finish()
@@ -160,6 +181,7 @@ func (s *RequestSuite) TestPublishParse(c *C) {
 	conn := NewMockConn(ctrl)
 	conn.EXPECT().Options().Return(options).AnyTimes()
 	conn.EXPECT().Server().Return(server).AnyTimes()
+	conn.EXPECT().AuthHelper().Return(NewAuthHelper(conn, &AuthConfig{})).AnyTimes()
 	conn.EXPECT().Read(gomock.Any()).Return(100, nil).Do(func(buf []byte) {
 		copy(buf, []byte("TEST"))
 	}).Times(2)
@@ -176,6 +198,275 @@ func (s *RequestSuite) TestPublishParse(c *C) {
 		&Message{Subject: "FOO", ReplyTo: "inbox", Content: []byte("TEST")}})
 }
 
+func (s *RequestSuite) TestHeaderPublishParse(c *C) {
+	ctrl := gomock.NewController(c)
+	defer ctrl.Finish()
+
+	payload := "NATS/1.0\r\nA: b\r\n\r\nTEST"
+	config := &Config{}
+	config.Limits.Payload = len(payload)
+	options := &ConnOptions{}
+	server := NewMockServer(ctrl)
+	server.EXPECT().Config().Return(config).AnyTimes()
+	conn := NewMockConn(ctrl)
+	conn.EXPECT().Options().Return(options).AnyTimes()
+	conn.EXPECT().Server().Return(server).AnyTimes()
+	conn.EXPECT().AuthHelper().Return(NewAuthHelper(conn, &AuthConfig{})).AnyTimes()
+	conn.EXPECT().Read(gomock.Any()).Return(len(payload), nil).Do(func(buf []byte) {
+		copy(buf, []byte(payload))
+	}).Times(2)
+	conn.EXPECT().ReadControlLine().Times(2)
+
+	req, err := ParseHeaderPublishRequest(conn, "FOO 18 22")
+	c.Assert(err, IsNil)
+	message := req.(*PublishRequest).Message
+	c.Check(message.Subject, Equals, "FOO")
+	c.Check(string(message.Content), Equals, "TEST")
+	c.Check(string(message.Header.Raw), Equals, "NATS/1.0\r\nA: b\r\n\r\n")
+	c.Check(message.Header.Values["A"], DeepEquals, []string{"b"})
+	c.Check(message.Size(), Equals, 22)
+
+	req, err = ParseHeaderPublishRequest(conn, "FOO inbox 18 22")
+	c.Assert(err, IsNil)
+	c.Check(req.(*PublishRequest).Message.ReplyTo, Equals, "inbox")
+
+	// The header counts against the payload limit
+	_, err = ParseHeaderPublishRequest(conn, "FOO 18 23")
+	c.Check(err, Equals, ErrPayloadTooBig)
+
+	for _, args := range []string{"FOO 22", "FOO 23 22", "FOO 4 22", "FOO x 22", "FOO a b 18 22"} {
+		_, err = ParseHeaderPublishRequest(conn, args)
+		c.Check(err, Equals, ErrUnknownOp, Commentf("args: %s", args))
+	}
+}
+
+func (s *RequestSuite) TestHeaderPublishParseInvalid(c *C) {
+	ctrl := gomock.NewController(c)
+	defer ctrl.Finish()
+
+	payload := "NATS/1.0\r\nA b\r\n\r\nTEST"
+	config := &Config{}
+	config.Limits.Payload = 100
+	server := NewMockServer(ctrl)
+	server.EXPECT().Config().Return(config).AnyTimes()
+	conn := NewMockConn(ctrl)
+	conn.EXPECT().Server().Return(server).AnyTimes()
+	conn.EXPECT().Read(gomock.Any()).Return(len(payload), nil).Do(func(buf []byte) {
+		copy(buf, []byte(payload))
+	})
+	conn.EXPECT().ReadControlLine()
+
+	_, err := ParseHeaderPublishRequest(conn, "FOO 17 21")
+	c.Check(err, Equals, ErrInvalidHeader)
+}
+
+func (s *RequestSuite) TestPublishParsePermissions(c *C) {
+	ctrl := gomock.NewController(c)
+	defer ctrl.Finish()
+
+	permissions, _ := NewPermissions(&PermissionsConfig{
+		Publish: SubjectPermissionsConfig{Allow: []string{"foo.*"}}})
+	auth := &AuthConfig{Users: map[string]string{"foo": "bar"},
+		UserPermissions: map[string]*Permissions{"foo": permissions}}
+
+	config := &Config{}
+	config.Limits.Payload = 100
+	server := NewMockServer(ctrl)
+	server.EXPECT().Config().Return(config).AnyTimes()
+	conn := NewMockConn(ctrl)
+	conn.EXPECT().Options().Return(&ConnOptions{}).AnyTimes()
+	conn.EXPECT().Server().Return(server).AnyTimes()
+	conn.EXPECT().RemoteAddr().Return(&DummyAddr{}).AnyTimes()
+	conn.EXPECT().Read(gomock.Any()).Return(100, nil).Do(func(buf []byte) {
+		copy(buf, []byte("TEST"))
+	}).Times(2)
+	conn.EXPECT().ReadControlLine().Times(2)
+
+	helper := NewAuthHelper(conn, auth)
+	defer helper.Stop()
+	user, password := "foo", "bar"
+	helper.Auth(&ConnectRequest{User: &user, Password: &password})
+	conn.EXPECT().AuthHelper().Return(helper).AnyTimes()
+
+	_, err := ParsePublishRequest(conn, "foo.bar 4")
+	c.Check(err, IsNil)
+
+	req, err := ParsePublishRequest(conn, "bar 4")
+	c.Check(err, Equals, ErrPermissions)
+	c.Check(req, IsNil)
+}
+
+func (s *RequestSuite) TestPublishParseSubjectLimits(c *C) {
+	ctrl := gomock.NewController(c)
+	defer ctrl.Finish()
+
+	config := &Config{}
+	config.Limits.Payload = 100
+	config.Limits.SubjectLength = 8
+	config.Limits.SubjectTokens = 3
+	stats := NewStats()
+	server := NewMockServer(ctrl)
+	server.EXPECT().Config().Return(config).AnyTimes()
+	server.EXPECT().Stats().Return(stats).AnyTimes()
+	conn := NewMockConn(ctrl)
+	conn.EXPECT().Options().Return(&ConnOptions{}).AnyTimes()
+	conn.EXPECT().Server().Return(server).AnyTimes()
+	conn.EXPECT().AuthHelper().Return(NewAuthHelper(conn, &AuthConfig{})).AnyTimes()
+	conn.EXPECT().Read(gomock.Any()).Return(100, nil).Do(func(buf []byte) {
+		copy(buf, []byte("TEST"))
+	}).Times(3)
+	conn.EXPECT().ReadControlLine().Times(3)
+
+	_, err := ParsePublishRequest(conn, "foo.bar 4")
+	c.Check(err, IsNil)
+
+	req, err := ParsePublishRequest(conn, "foo.bar.baz 4")
+	c.Check(err, Equals, ErrSubjectTooLong)
+	c.Check(req, IsNil)
+
+	req, err = ParsePublishRequest(conn, "a.b.c.d 4")
+	c.Check(err, Equals, ErrSubjectTooDeep)
+	c.Check(req, IsNil)
+}
+
+func (s *RequestSuite) TestSubscriptionParseSubjectLimits(c *C) {
+	ctrl := gomock.NewController(c)
+	defer ctrl.Finish()
+
+	config := &Config{}
+	config.Limits.SubjectTokens = 2
+	server := NewMockServer(ctrl)
+	server.EXPECT().Config().Return(config).AnyTimes()
+	server.EXPECT().Stats().Return(NewStats()).AnyTimes()
+	conn := NewMockConn(ctrl)
+	conn.EXPECT().Server().Return(server).AnyTimes()
+
+	_, err := ParseSubscriptionRequest(conn, "foo.* 1")
+	c.Check(err, IsNil)
+
+	req, err := ParseSubscriptionRequest(conn, "foo.*.> 1")
+	c.Check(err, Equals, ErrSubjectTooDeep)
+	c.Check(req, IsNil)
+}
+
+func (s *RequestSuite) TestSubscriptionServeMaxSubs(c *C) {
+	ctrl := gomock.NewController(c)
+	defer ctrl.Finish()
+
+	config := &Config{}
+	config.Limits.Subscriptions = 1
+	server := NewMockServer(ctrl)
+	server.EXPECT().Config().Return(config).AnyTimes()
+	server.EXPECT().Stats().Return(NewStats()).AnyTimes()
+	subscriptions := map[int]*Subscription{1: &Subscription{}}
+	conn := NewMockConn(ctrl)
+	conn.EXPECT().Server().Return(server).AnyTimes()
+	conn.EXPECT().Subscriptions().Return(subscriptions).AnyTimes()
+	conn.EXPECT().AuthHelper().Return(NewAuthHelper(conn, &AuthConfig{})).AnyTimes()
+	conn.EXPECT().Route().Return(nil)
+
+	req := &SubscriptionRequest{&Subscription{Id: 2, Subject: "foo"}, make(chan bool, 1)}
+	c.Check(req.Serve(conn), DeepEquals, &Response{Value: &ErrMaxSubsExceeded.Message})
+	c.Check(<-req.Done, Equals, true)
+	c.Check(subscriptions, HasLen, 1)
+}
+
+func (s *RequestSuite) TestSubscriptionServeHeaders(c *C) {
+	ctrl := gomock.NewController(c)
+	defer ctrl.Finish()
+
+	server := NewMockServer(ctrl)
+	server.EXPECT().Config().Return(&Config{}).AnyTimes()
+	subscriptions := make(map[int]*Subscription)
+	account := NewAccount(GLOBAL_ACCOUNT)
+	conn := NewMockConn(ctrl)
+	conn.EXPECT().Server().Return(server).AnyTimes()
+	conn.EXPECT().Subscriptions().Return(subscriptions).AnyTimes()
+	conn.EXPECT().AuthHelper().Return(NewAuthHelper(conn, &AuthConfig{})).AnyTimes()
+	conn.EXPECT().Options().Return(&ConnOptions{Headers: true}).AnyTimes()
+	conn.EXPECT().Account().Return(account)
+	conn.EXPECT().SendServerCmd(gomock.Any())
+
+	req := &SubscriptionRequest{&Subscription{Id: 1, Subject: "foo"}, make(chan bool, 1)}
+	c.Check(req.Serve(conn), IsNil)
+	c.Check(subscriptions[1].Headers, Equals, true)
+	c.Check(subscriptions[1].Account, Equals, account)
+}
+
+func (s *RequestSuite) TestConnectDispatch(c *C) {
+	ctrl := gomock.NewController(c)
+	defer ctrl.Finish()
+
+	conn := NewMockConn(ctrl)
+	req, err := ParseConnectRequest(conn, "{}")
+	c.Assert(err, IsNil)
+
+	done := make(chan bool)
+	conn.EXPECT().ServeRequest(req)
+	go func() {
+		req.Dispatch(conn)
+		done <- true
+	}()
+
+	select {
+	case <-done:
+		c.Errorf("Should wait for the dispatch loop")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	req.(*ConnectRequest).Done <- true
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		c.Errorf("Should have finished dispatching")
+	}
+}
+
+func (s *RequestSuite) TestConnectServeOptions(c *C) {
+	ctrl := gomock.NewController(c)
+	defer ctrl.Finish()
+
+	options := &ConnOptions{Echo: true}
+	client := &ClientInfo{}
+	conn := NewMockConn(ctrl)
+	conn.EXPECT().Options().Return(options).AnyTimes()
+	conn.EXPECT().Client().Return(client).AnyTimes()
+	conn.EXPECT().RemoteAddr().Return(&net.TCPAddr{}).AnyTimes()
+
+	req, err := ParseConnectRequest(conn, `{"verbose":false,"no_responders":true}`)
+	c.Assert(err, IsNil)
+	req.Serve(conn)
+	c.Check(*options, Equals, ConnOptions{Echo: true})
+
+	req, err = ParseConnectRequest(conn, `{"verbose":false,"headers":true,"no_responders":true}`)
+	c.Assert(err, IsNil)
+	req.Serve(conn)
+	c.Check(*options, Equals, ConnOptions{Headers: true, NoResponders: true, Echo: true})
+
+	req, err = ParseConnectRequest(conn,
+		`{"verbose":false,"echo":false,"protocol":1,"name":"billing","lang":"go","version":"1.2.0"}`)
+	c.Assert(err, IsNil)
+	req.Serve(conn)
+	c.Check(options.Echo, Equals, false)
+	c.Check(options.Protocol, Equals, PROTOCOL_DYNAMIC)
+	c.Check(*client, Equals, ClientInfo{Name: "billing", Lang: "go", Version: "1.2.0"})
+}
+
+func (s *RequestSuite) TestConnectParseProtocol(c *C) {
+	ctrl := gomock.NewController(c)
+	defer ctrl.Finish()
+
+	conn := NewMockConn(ctrl)
+	for _, protocol := range []string{"0", "1"} {
+		_, err := ParseConnectRequest(conn, `{"protocol":`+protocol+`}`)
+		c.Check(err, IsNil)
+	}
+	for _, protocol := range []string{"-1", "2"} {
+		_, err := ParseConnectRequest(conn, `{"protocol":`+protocol+`}`)
+		c.Check(err, Equals, ErrUnknownProtocol)
+	}
+}
+
 func (s *RequestSuite) TestPublishParseNoArgs(c *C) {
 	ctrl := gomock.NewController(c)
 	defer ctrl.Finish()
@@ -298,10 +589,12 @@ func (s *RequestSuite) TestPublishDispatch(c *C) {
 	server := NewMockServer(ctrl)
 	server.EXPECT().Commands().Return(serverCmds).AnyTimes()
 
-	options := &ConnOptions{}
+	options := &ConnOptions{Echo: true, Headers: true, NoResponders: true}
 	conn := NewMockConn(ctrl)
 	conn.EXPECT().Options().Return(options).AnyTimes()
 	conn.EXPECT().Server().Return(server).AnyTimes()
+	account := NewAccount(GLOBAL_ACCOUNT)
+	conn.EXPECT().Account().Return(account)
 
 	msg := &Message{Subject: "Foo"}
 	req := &PublishRequest{msg}
@@ -309,7 +602,11 @@ func (s *RequestSuite) TestPublishDispatch(c *C) {
 
 	select {
 	case cmd := <-serverCmds:
-		c.Check(cmd, DeepEquals, &PublishCmd{msg})
+		c.Check(cmd.(*PublishCmd).Message, Equals, msg)
+		c.Check(cmd.(*PublishCmd).Account, Equals, account)
+		c.Check(cmd.(*PublishCmd).Echo, Equals, true)
+		c.Check(cmd.(*PublishCmd).NoResponders, Equals, true)
+		c.Check(cmd.(*PublishCmd).Enqueued.IsZero(), Equals, false)
 	case <-time.After(time.Second):
 		c.Errorf("Did not dispatch server command")
 	}
@@ -327,6 +624,8 @@ func (s *RequestSuite) TestPublishDispatchVerbose(c *C) {
 	conn := NewMockConn(ctrl)
 	conn.EXPECT().Options().Return(options).AnyTimes()
 	conn.EXPECT().Server().Return(server).AnyTimes()
+	account := NewAccount(GLOBAL_ACCOUNT)
+	conn.EXPECT().Account().Return(account)
 
 	msg := &Message{Subject: "Foo"}
 	req := &PublishRequest{msg}
@@ -335,7 +634,9 @@ func (s *RequestSuite) TestPublishDispatchVerbose(c *C) {
 
 	select {
 	case cmd := <-serverCmds:
-		c.Check(cmd, DeepEquals, &PublishCmd{msg})
+		c.Check(cmd.(*PublishCmd).Message, Equals, msg)
+		c.Check(cmd.(*PublishCmd).Account, Equals, account)
+		c.Check(cmd.(*PublishCmd).Enqueued.IsZero(), Equals, false)
 	case <-time.After(time.Second):
 		c.Errorf("Did not dispatch server command")
 	}
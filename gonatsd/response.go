@@ -4,14 +4,16 @@ package gonatsd
 
 import (
 	"io"
+	"time"
 )
 
 // NATS response payload.
 // Instead of having a single string or byte array we can pass the original
 // message instead of copying it to the client.
 type Response struct {
-	Value *string
-	Bytes *[]byte
+	Value     *string
+	Bytes     *[]byte
+	Delivered time.Time // when the message was delivered to the connection, if any
 }
 
 func NewStringResponse(value string) *Response {
@@ -23,7 +25,7 @@ func NewByteResponse(bytes []byte) *Response {
 }
 
 func NewResponse(value string, bytes []byte) *Response {
-	return &Response{&value, &bytes}
+	return &Response{Value: &value, Bytes: &bytes}
 }
 
 func (r *Response) Size() (result int32) {
@@ -3,7 +3,7 @@
 package gonatsd
 
 import (
-	"encoding/base64"
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"net"
@@ -12,7 +12,9 @@ import (
 	"os"
 	"runtime"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -20,16 +22,20 @@ import (
 const (
 	VERSION                = "0.0.1"
 	DEFAULT_SERVER_BACKLOG = 1024
+	DRAIN_POLL_INTERVAL    = 10 * time.Millisecond
 )
 
 type Info struct {
-	ServerId     string `json:"server_id"`
-	Host         string `json:"host"`
-	Port         int    `json:"port"`
-	Version      string `json:"version"`
-	AuthRequired bool   `json:"auth_required"`
-	SslRequired  bool   `json:"ssl_required"`
-	MaxPayload   int    `json:"max_payload"`
+	ServerId     string   `json:"server_id"`
+	Host         string   `json:"host"`
+	Port         int      `json:"port"`
+	Version      string   `json:"version"`
+	AuthRequired bool     `json:"auth_required"`
+	AuthMethods  []string `json:"auth_methods,omitempty"`
+	SslRequired  bool     `json:"ssl_required"`
+	MaxPayload   int      `json:"max_payload"`
+	Headers      bool     `json:"headers"`
+	LameDuckMode bool     `json:"ldm,omitempty"`
 }
 
 type Stats struct {
@@ -44,7 +50,18 @@ type Stats struct {
 	payload_too_big int64
 	unresponsive    int64
 	bad_auth        int64
+	throttled       int64
+	rate_limited    int64
+	max_subs        int64
+	max_user_conns  int64
+	max_ip_conns    int64
+	subject_length  int64
+	subject_tokens  int64
 	errors          int64
+	no_responders   int64
+	publish_latency *Histogram // microseconds from publish to matching
+	write_latency   *Histogram // microseconds from delivery to write
+	payload_size    *Histogram
 }
 
 func NewStats() *Stats {
@@ -56,26 +73,51 @@ func NewStats() *Stats {
 		stats.ops[request] = &ops
 		stats.bad_ops[request] = &bad_ops
 	}
+	stats.publish_latency = NewHistogram(DEFAULT_HISTOGRAM_WINDOW)
+	stats.write_latency = NewHistogram(DEFAULT_HISTOGRAM_WINDOW)
+	stats.payload_size = NewHistogram(DEFAULT_HISTOGRAM_WINDOW)
 	return stats
 }
 
 type Server interface {
 	Start()
+	Shutdown(timeout time.Duration)
+	LameDuck(window time.Duration)
+	Reload(config *Config)
 	DeliverMessage(subscription *Subscription, message *Message)
+	RegisterUser(conn Conn, user string) bool
 	Commands() chan<- ServerCmd
-	Subscriptions() *Trie
+	Account(name string) *Account
 	Info() *[]byte
+	UpdateInfo(update func(info *Info))
 	Stats() *Stats
 	Config() *Config
+	Cluster() *Cluster
 }
 
 type server struct {
-	commands      chan ServerCmd
-	config        *Config
-	subscriptions *Trie
-	connections   int64
-	info          []byte
-	stats         *Stats
+	commands     chan ServerCmd
+	config       *Config
+	configLock   sync.RWMutex
+	logOut       *os.File
+	accounts     map[string]*Account
+	cluster      *Cluster
+	connections  int64
+	serverId     string
+	serverInfo   Info
+	info         []byte
+	stats        *Stats
+	lock         sync.Mutex
+	listeners    []net.Listener
+	listener     net.Listener
+	conns        map[Conn]bool
+	connUsers    map[Conn]string
+	userConns    map[string]int
+	ipConns      map[string]int
+	connsDone    sync.WaitGroup
+	shuttingDown bool
+	lameDuck     bool
+	done         chan bool
 }
 
 func NewServer(config *Config) (Server, error) {
@@ -83,9 +125,21 @@ func NewServer(config *Config) (Server, error) {
 	s.commands = make(chan ServerCmd, DEFAULT_SERVER_BACKLOG)
 	s.config = config
 	s.stats = NewStats()
-	s.subscriptions = NewTrie(".")
+	s.serverId = newServerId()
+	s.cluster = NewCluster(s.serverId, s.clustered())
+	s.conns = make(map[Conn]bool)
+	s.connUsers = make(map[Conn]string)
+	s.userConns = make(map[string]int)
+	s.ipConns = make(map[string]int)
+	s.done = make(chan bool)
+
+	var err error
+	s.accounts, err = NewAccounts(config.Accounts)
+	if err != nil {
+		return nil, err
+	}
 
-	err := s.initLogger()
+	err = s.initLogger()
 	if err != nil {
 		return nil, err
 	}
@@ -93,103 +147,430 @@ func NewServer(config *Config) (Server, error) {
 	return s, nil
 }
 
+// Config returns the current configuration, which is replaced on reload.
 func (s *server) Config() *Config {
+	s.configLock.RLock()
+	defer s.configLock.RUnlock()
 	return s.config
 }
 
+// Reload applies the configuration at runtime. Options that can't change
+// without a restart are reported and keep their current values.
+// Users that were removed are disconnected, the other limits apply to new
+// connections, except for the payload and control line limits which apply
+// right away. The clients get the new auth config through their command
+// channel, the ones with a full backlog get it once they catch up.
+func (s *server) Reload(config *Config) {
+	s.configLock.Lock()
+	reloaded, ignored := s.config.Reload(config)
+	levelChanged := reloaded.Log.MinLevel != s.config.Log.MinLevel
+	s.config = reloaded
+	s.configLock.Unlock()
+
+	for _, option := range ignored {
+		Log.Warnf("Can't reload %s without a restart, keeping the current value", option)
+	}
+
+	if levelChanged {
+		logger, err := NewLogger(s.logOut, reloaded.Log.MinLevel)
+		if err != nil {
+			Log.Warnf("Can't reload logging level: %s", err)
+		} else {
+			ReplaceLogger(logger)
+		}
+	}
+
+	s.UpdateInfo(func(info *Info) {
+		info.AuthRequired = reloaded.Auth.Required()
+		info.AuthMethods = reloaded.Auth.Methods()
+		info.MaxPayload = reloaded.Limits.Payload
+	})
+
+	clients := s.clients()
+	for _, conn := range clients {
+		cmd := &ReloadAuthCmd{&reloaded.Auth}
+		if !conn.TryServeCommand(cmd) {
+			go conn.ServeCommand(cmd)
+		}
+	}
+
+	Log.Infof("Reloaded config [users: %d] [tokens: %d] [certificates: %d] [clients: %d]",
+		len(reloaded.Auth.Users), len(reloaded.Auth.Tokens), len(reloaded.Auth.Certificates), len(clients))
+}
+
+// Info returns the INFO payload, which is replaced by UpdateInfo.
 func (s *server) Info() *[]byte {
-	return &s.info
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	info := s.info
+	return &info
+}
+
+// UpdateInfo changes the server info and, if the INFO payload changed,
+// pushes it to the clients. Only the clients that connected with a dynamic
+// protocol get the update, it goes through their command channel so it's
+// ordered with the other writes. Clients whose command backlog is full are
+// skipped rather than holding up the others.
+func (s *server) UpdateInfo(update func(info *Info)) {
+	s.lock.Lock()
+	update(&s.serverInfo)
+	info, _ := json.Marshal(&s.serverInfo)
+	changed := !bytes.Equal(info, s.info)
+	s.info = info
+	s.lock.Unlock()
+
+	if !changed {
+		return
+	}
+	for _, conn := range s.clients() {
+		if !conn.TryServeCommand(INFO_UPDATE_CMD) {
+			Log.Warnf("[client %s] command backlog full, skipped INFO update", conn.RemoteAddr())
+		}
+	}
+}
+
+// Returns the connected clients, leaving out the routes.
+func (s *server) clients() []Conn {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	clients := make([]Conn, 0, len(s.conns))
+	for conn, _ := range s.conns {
+		if conn.Route() == nil {
+			clients = append(clients, conn)
+		}
+	}
+	return clients
 }
 
 func (s *server) Commands() chan<- ServerCmd {
 	return s.commands
 }
 
-func (s *server) Subscriptions() *Trie {
-	return s.subscriptions
+// Account returns the named account, the global one for an empty name.
+// Accounts can't change at runtime so this is safe to call from any
+// goroutine, their subscriptions must still only be used from the server
+// loop.
+func (s *server) Account(name string) *Account {
+	if len(name) == 0 {
+		return s.accounts[GLOBAL_ACCOUNT]
+	}
+	return s.accounts[name]
 }
 
 func (s *server) Stats() *Stats {
 	return s.stats
 }
 
+func (s *server) Cluster() *Cluster {
+	return s.cluster
+}
+
 func (s *server) Start() {
+	config := s.Config()
 	s.exportPprof()
 	s.exportVarz()
 
-	authRequired := len(s.config.Auth.Users) > 0
-	Log.Infof("Starting server on: %s [auth: %v] [users: %d]", s.config.BindAddress, authRequired,
-		len(s.config.Auth.Users))
-	ln, err := net.Listen("tcp", s.config.BindAddress)
-	if err != nil {
-		Log.Fatalf("Could not listen: %s", err)
-		os.Exit(1)
-	}
+	authRequired := config.Auth.Required()
+	sslRequired := config.TLS.ServerConfig != nil
+	Log.Infof("Starting server on: %s [auth: %v] [users: %d] [tokens: %d] [certificates: %d] [tls: %v]",
+		config.BindAddress, authRequired, len(config.Auth.Users), len(config.Auth.Tokens),
+		len(config.Auth.Certificates), sslRequired)
+	ln := s.listen(config.BindAddress)
 
 	addr := ln.Addr().(*net.TCPAddr)
-	info := &Info{"my_server_id", addr.IP.String(), addr.Port, VERSION, authRequired, false,
-		s.config.Limits.Payload}
-	s.info, _ = json.Marshal(info)
+	s.lock.Lock()
+	s.listener = ln
+	s.serverInfo = Info{s.serverId, addr.IP.String(), addr.Port, VERSION, authRequired,
+		config.Auth.Methods(), sslRequired, config.Limits.Payload, true, false}
+	s.info, _ = json.Marshal(&s.serverInfo)
+	s.lock.Unlock()
 
 	s.bindMetrics()
+	s.pushMetrics()
 
 	go s.loop()
 
+	if s.clustered() {
+		s.startCluster()
+	}
+
+	s.accept(ln, func(nc net.Conn) {
+		s.processConn(nc)
+	})
+	<-s.done
+}
+
+// Shutdown stops accepting connections, gives every connection until the
+// timeout to flush its pending writes and then closes them with an error.
+// Returns once all connections are gone or the timeout expired.
+func (s *server) Shutdown(timeout time.Duration) {
+	s.lock.Lock()
+	if s.shuttingDown {
+		s.lock.Unlock()
+		return
+	}
+	s.shuttingDown = true
+	listeners := s.listeners
+	conns := make([]Conn, 0, len(s.conns))
+	for conn, _ := range s.conns {
+		conns = append(conns, conn)
+	}
+	s.lock.Unlock()
+
+	Log.Infof("Shutting down server [connections: %d] [timeout: %s]", len(conns), timeout)
+
+	for _, ln := range listeners {
+		ln.Close()
+	}
+
+	deadline := time.Now().Add(timeout)
+	for _, conn := range conns {
+		go drainConn(conn, deadline, ErrServerShutdown)
+	}
+
+	finished := make(chan bool)
+	go func() {
+		s.connsDone.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		Log.Infof("Server shut down")
+	case <-time.After(deadline.Sub(time.Now()) + time.Second):
+		Log.Warnf("Server shut down with connections still open")
+	}
+	close(s.done)
+}
+
+// LameDuck stops accepting client connections, tells the connected clients
+// to migrate with an INFO update and then closes them one at a time spread
+// over the window, so they don't all reconnect elsewhere at once. Clients
+// with a full command backlog don't hold up the others. The server shuts
+// down at the end of the window.
+func (s *server) LameDuck(window time.Duration) {
+	s.lock.Lock()
+	if s.shuttingDown || s.lameDuck {
+		s.lock.Unlock()
+		return
+	}
+	s.lameDuck = true
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	s.lock.Unlock()
+
+	s.UpdateInfo(func(info *Info) {
+		info.LameDuckMode = true
+	})
+
+	clients := s.clients()
+	Log.Infof("Entering lame duck mode [clients: %d] [window: %s]", len(clients), window)
+
+	if len(clients) > 0 {
+		interval := window / time.Duration(len(clients))
+		for _, conn := range clients {
+			time.Sleep(interval)
+			cmd := &CloseWithErrorCmd{ErrServerLameDuck}
+			if !conn.TryServeCommand(cmd) {
+				go conn.ServeCommand(cmd)
+			}
+		}
+	}
+
+	s.Shutdown(s.Config().Shutdown.TimeoutDuration)
+}
+
+// Waits until the connection flushed its pending writes or the deadline
+// passed and then closes it with the error.
+func drainConn(conn Conn, deadline time.Time, err *NATSError) {
+	for conn.Pending() > 0 && time.Now().Before(deadline) {
+		time.Sleep(DRAIN_POLL_INTERVAL)
+	}
+	conn.ServeCommand(&CloseWithErrorCmd{err})
+}
+
+func (s *server) isShuttingDown() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.shuttingDown
+}
+
+// Returns true iff the server no longer takes client connections.
+func (s *server) isDraining() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.shuttingDown || s.lameDuck
+}
+
+// Listen on the address, the listener is closed on shutdown.
+func (s *server) listen(address string) net.Listener {
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		Log.Fatalf("Could not listen: %s", err)
+		os.Exit(1)
+	}
+
+	s.lock.Lock()
+	s.listeners = append(s.listeners, ln)
+	s.lock.Unlock()
+	return ln
+}
+
+// Accept connections until the listener is closed on shutdown or in lame
+// duck mode.
+func (s *server) accept(ln net.Listener, handler func(net.Conn)) {
 	for {
 		nc, err := ln.Accept()
 		if err != nil {
+			if s.isDraining() {
+				return
+			}
 			Log.Fatalf("Could not accept: %s", err)
 			os.Exit(1)
 		}
-		go s.processConn(nc)
+		go handler(nc)
+	}
+}
+
+// Serve HTTP on the address until the listener is closed on shutdown.
+func (s *server) serveHTTP(address string, handler http.Handler) {
+	ln := s.listen(address)
+	go func() {
+		err := http.Serve(ln, handler)
+		if err != nil && !s.isShuttingDown() {
+			Log.Fatalf("Could not serve: %s", err)
+			os.Exit(1)
+		}
+	}()
+}
+
+// Track the connection until it's closed.
+// Returns false if the server is shutting down and won't take new
+// connections.
+func (s *server) register(conn Conn) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.shuttingDown {
+		return false
+	}
+	s.conns[conn] = true
+	s.connsDone.Add(1)
+	return true
+}
+
+func (s *server) unregister(conn Conn) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.conns, conn)
+	if user, ok := s.connUsers[conn]; ok {
+		delete(s.connUsers, conn)
+		s.userConns[user]--
+		if s.userConns[user] == 0 {
+			delete(s.userConns, user)
+		}
+	}
+	s.connsDone.Done()
+}
+
+// RegisterUser counts the connection against the connections of the user
+// it authenticated as, until it's unregistered.
+// Returns false iff the user already has the maximum number of connections.
+func (s *server) RegisterUser(conn Conn, user string) bool {
+	if len(user) == 0 {
+		return true
+	}
+
+	limit := s.Config().Limits.UserConnections
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.connUsers[conn]; ok {
+		return true
+	}
+	if limit > 0 && s.userConns[user] >= limit {
+		return false
+	}
+	s.connUsers[conn] = user
+	s.userConns[user]++
+	return true
+}
+
+// Count a client connection from the address.
+// Returns the number of connections from it, including this one.
+func (s *server) addIPConn(ip string) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.ipConns[ip]++
+	return s.ipConns[ip]
+}
+
+func (s *server) removeIPConn(ip string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.ipConns[ip]--
+	if s.ipConns[ip] == 0 {
+		delete(s.ipConns, ip)
 	}
 }
 
 func (s *server) DeliverMessage(subscription *Subscription, message *Message) {
-	subscribedMessage := &SubscribedMessage{Subscription: subscription, Message: message}
+	subscribedMessage := &SubscribedMessage{Subscription: subscription, Message: message, Delivered: time.Now()}
 	subscription.Responses++
 	if subscription.MaxResponses > 0 && subscription.Responses >= uint64(subscription.MaxResponses) {
-		s.Subscriptions().Delete(subscription.Subject, subscription)
+		subscription.Account.Subscriptions.Delete(subscription.Subject, subscription)
+		s.Cluster().Unsubscribed(subscription)
 		subscribedMessage.Last = true
 	}
 	subscription.Conn.ServeMessage(subscribedMessage)
 	atomic.AddInt64(&s.stats.msg_sent, 1)
-	atomic.AddInt64(&s.stats.bytes_sent, int64(len(message.Content)))
+	atomic.AddInt64(&s.stats.bytes_sent, int64(message.Size()))
 }
 
 func (s *server) exportPprof() {
-	if len(s.config.Profile.BindAddress) > 0 {
+	config := s.Config()
+	if len(config.Profile.BindAddress) > 0 {
 		mux := http.NewServeMux()
 		mux.Handle("/debug/pprof/", http.HandlerFunc(httppprof.Index))
 		mux.Handle("/debug/pprof/cmdline", http.HandlerFunc(httppprof.Cmdline))
 		mux.Handle("/debug/pprof/profile", http.HandlerFunc(httppprof.Profile))
 		mux.Handle("/debug/pprof/symbol", http.HandlerFunc(httppprof.Symbol))
-		Log.Infof("Starting pprof server on: %s", s.config.Profile.BindAddress)
-		go func() {
-			err := http.ListenAndServe(s.config.Profile.BindAddress, mux)
-			if err != nil {
-				Log.Fatalf("Could not listen: %s", err)
-				os.Exit(1)
-			}
-		}()
+		Log.Infof("Starting pprof server on: %s", config.Profile.BindAddress)
+		s.serveHTTP(config.Profile.BindAddress, mux)
 	}
 }
 
 func (s *server) exportVarz() {
-	if len(s.config.Varz.BindAddress) > 0 {
+	config := s.Config()
+	if len(config.Varz.BindAddress) > 0 {
 		mux := http.NewServeMux()
 		varzHandler := func(w http.ResponseWriter, r *http.Request) {
 			s.varzHandler(w, r)
 		}
-		mux.Handle("/varz", NewBasicAuthHandler(s.config.Varz.Users, varzHandler))
-		Log.Infof("Starting /varz endpoint on: %s", s.config.Varz.BindAddress)
-		go func() {
-			err := http.ListenAndServe(s.config.Varz.BindAddress, mux)
-			if err != nil {
-				Log.Fatalf("Could not listen: %s", err)
-				os.Exit(1)
-			}
-		}()
+		mux.Handle("/varz", NewBasicAuthHandler(config.Varz.Users, varzHandler))
+		connzHandler := func(w http.ResponseWriter, r *http.Request) {
+			s.connzHandler(w, r)
+		}
+		mux.Handle("/connz", NewBasicAuthHandler(config.Varz.Users, connzHandler))
+		subszHandler := func(w http.ResponseWriter, r *http.Request) {
+			s.subszHandler(w, r)
+		}
+		mux.Handle("/subsz", NewBasicAuthHandler(config.Varz.Users, subszHandler))
+		metricsHandler := func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", PROMETHEUS_CONTENT_TYPE)
+			DefaultRegistry.WritePrometheus(w)
+		}
+		mux.Handle("/metrics", NewBasicAuthHandler(config.Varz.Users, metricsHandler))
+		Log.Infof("Starting /varz, /connz, /subsz and /metrics endpoints on: %s", config.Varz.BindAddress)
+		s.serveHTTP(config.Varz.BindAddress, mux)
+	}
+}
+
+func (s *server) pushMetrics() {
+	config := s.Config()
+	push := &config.Metrics.Push
+	if len(push.Address) > 0 {
+		Log.Infof("Pushing metrics to %s: %s every %v", push.Protocol, push.Address, push.IntervalDuration)
+		go NewPusher(DefaultRegistry, push).Loop()
 	}
 }
 
@@ -201,29 +582,110 @@ func (s *server) loop() {
 
 func (s *server) processConn(nc net.Conn) {
 	connections := atomic.AddInt64(&s.connections, 1)
-	conn := NewConn(s, nc.(*net.TCPConn))
-	if s.config.Limits.Connections > 0 && connections > int64(s.config.Limits.Connections) {
+	defer atomic.AddInt64(&s.connections, -1)
+
+	config := s.Config()
+	var tc TCPConn = nc.(*net.TCPConn)
+	if config.TLS.ServerConfig != nil {
+		tlsConn := NewTLSConn(tc, config.TLS.ServerConfig)
+		err := tlsConn.HandshakeWithTimeout(config.TLS.TimeoutDuration)
+		if err != nil {
+			Log.Warnf("[client %s] TLS handshake failed: %s", nc.RemoteAddr(), err)
+			nc.Close()
+			return
+		}
+		tc = tlsConn
+	}
+
+	conn := NewConn(s, tc)
+	if !s.register(conn) {
+		conn.CloseWithError(ErrServerShutdown)
+		return
+	}
+	defer s.unregister(conn)
+
+	ip := nc.RemoteAddr().(*net.TCPAddr).IP.String()
+	ipConnections := s.addIPConn(ip)
+	defer s.removeIPConn(ip)
+
+	limits := config.Limits
+	if limits.Connections > 0 && connections > int64(limits.Connections) {
 		conn.CloseWithError(ErrMaxConnsExceeded)
+	} else if limits.IPConnections > 0 && ipConnections > limits.IPConnections {
+		conn.CloseWithError(ErrMaxIPConns)
 	}
 	conn.Start()
-	atomic.AddInt64(&s.connections, -1)
+}
+
+func (s *server) clustered() bool {
+	config := s.Config()
+	return len(config.Cluster.BindAddress) > 0 || len(config.Cluster.Routes) > 0
+}
+
+func (s *server) startCluster() {
+	config := s.Config()
+	Log.Infof("Starting cluster [server id: %s] [routes: %d]", s.serverId, len(config.Cluster.Routes))
+
+	if len(config.Cluster.BindAddress) > 0 {
+		Log.Infof("Starting route listener on: %s", config.Cluster.BindAddress)
+		ln := s.listen(config.Cluster.BindAddress)
+		go s.accept(ln, func(nc net.Conn) {
+			s.processRoute(nc, &Route{})
+		})
+	}
+
+	for _, address := range config.Cluster.Routes {
+		go s.connectRoute(address)
+	}
+}
+
+func (s *server) processRoute(nc net.Conn, route *Route) {
+	conn := NewRouteConn(s, nc.(*net.TCPConn), route)
+	if !s.register(conn) {
+		conn.CloseWithError(ErrServerShutdown)
+		return
+	}
+	defer s.unregister(conn)
+
+	conn.Start()
+}
+
+// Keeps a route to the specified address connected, unless it turns out
+// to be redundant.
+func (s *server) connectRoute(address string) {
+	for !s.isShuttingDown() {
+		nc, err := net.Dial("tcp", address)
+		if err == nil {
+			route := &Route{Address: address, Outbound: true}
+			s.processRoute(nc, route)
+			if route.Duplicate {
+				Log.Infof("[route %s] redundant, no longer connecting", address)
+				return
+			}
+		} else {
+			Log.Debugf("[route %s] could not connect: %s", address, err)
+		}
+		time.Sleep(s.Config().Cluster.ReconnectDuration)
+	}
 }
 
 func (s *server) initLogger() (err error) {
+	config := s.Config()
 	logOut := os.Stdout
 
-	if len(s.config.Log.Out) > 0 {
-		logOut, err = os.OpenFile(s.config.Log.Out, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0666)
+	if len(config.Log.Out) > 0 {
+		logOut, err = os.OpenFile(config.Log.Out, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0666)
 		if err != nil {
 			return err
 		}
 	}
 
-	logger, err := NewLogger(logOut, s.config.Log.MinLevel)
+	logger, err := NewLogger(logOut, config.Log.MinLevel)
 	if err != nil {
 		return err
 	}
 
+	s.logOut = logOut
 	ReplaceLogger(logger)
 	return nil
 }
@@ -242,11 +704,20 @@ func (s *server) bindMetrics() {
 	})
 
 	DefaultRegistry.NewGauge("subscriptions", func() string {
-		return fmt.Sprint(s.Subscriptions().Values())
+		values := 0
+		for _, account := range s.accounts {
+			values += account.Subscriptions.Values()
+		}
+		return fmt.Sprint(values)
 	})
 	DefaultRegistry.NewGauge("subscriptions.nodes", func() string {
-		return fmt.Sprint(s.Subscriptions().Nodes())
+		nodes := 0
+		for _, account := range s.accounts {
+			nodes += account.Subscriptions.Nodes()
+		}
+		return fmt.Sprint(nodes)
 	})
+	DefaultRegistry.NewStringVal("accounts", fmt.Sprint(len(s.accounts)))
 
 	for _, request := range REQUESTS {
 		name := fmt.Sprintf("ops.%s", strings.ToLower(request))
@@ -259,9 +730,20 @@ func (s *server) bindMetrics() {
 	DefaultRegistry.NewCounter("errors.slow", &s.Stats().slow_consumer)
 	DefaultRegistry.NewCounter("errors.payload_too_big", &s.Stats().payload_too_big)
 	DefaultRegistry.NewCounter("errors.unknown", &s.Stats().unkown_ops)
+	DefaultRegistry.NewCounter("errors.rate_limited", &s.Stats().rate_limited)
+	DefaultRegistry.NewCounter("errors.max_subscriptions", &s.Stats().max_subs)
+	DefaultRegistry.NewCounter("errors.max_user_connections", &s.Stats().max_user_conns)
+	DefaultRegistry.NewCounter("errors.max_ip_connections", &s.Stats().max_ip_conns)
+	DefaultRegistry.NewCounter("errors.subject_length", &s.Stats().subject_length)
+	DefaultRegistry.NewCounter("errors.subject_tokens", &s.Stats().subject_tokens)
+	DefaultRegistry.NewCounter("limits.throttled", &s.Stats().throttled)
+	DefaultRegistry.NewCounter("no_responders", &s.Stats().no_responders)
 	DefaultRegistry.NewCounter("errors.unresponsive", &s.Stats().unresponsive)
 
 	DefaultRegistry.NewCounter("conns", &s.connections)
+	DefaultRegistry.NewGauge("cluster.routes", func() string {
+		return fmt.Sprint(atomic.LoadInt64(&s.cluster.routeCount))
+	})
 	DefaultRegistry.NewCounter("msg_recv", &s.stats.msg_recv)
 	DefaultRegistry.NewCounter("msg_sent", &s.stats.msg_sent)
 	DefaultRegistry.NewCounter("bytes_recv", &s.stats.bytes_recv)
@@ -272,6 +754,10 @@ func (s *server) bindMetrics() {
 	DefaultRegistry.NewRates("bytes_recv.rate", &s.stats.bytes_recv, "10s", "1m", "5m")
 	DefaultRegistry.NewRates("bytes_sent.rate", &s.stats.bytes_sent, "10s", "1m", "5m")
 
+	DefaultRegistry.AddHistogram("latency.publish_us", s.stats.publish_latency)
+	DefaultRegistry.AddHistogram("latency.write_us", s.stats.write_latency)
+	DefaultRegistry.AddHistogram("payload.bytes", s.stats.payload_size)
+
 	DefaultRegistry.NewGauge("runtime.goroutines", func() string {
 		return fmt.Sprint(runtime.NumGoroutine())
 	})
@@ -316,7 +802,31 @@ func (s *server) bindMetrics() {
 	}()
 }
 
+// Serves the metrics as nested JSON objects along with the server info and
+// limits, or as a flat object of strings with the "format=flat" parameter.
 func (s *server) varzHandler(w http.ResponseWriter, r *http.Request) {
+	if r.FormValue("format") == "flat" {
+		s.flatVarzHandler(w, r)
+		return
+	}
+
+	s.lock.Lock()
+	info := s.serverInfo
+	s.lock.Unlock()
+
+	var varz map[string]interface{}
+	DefaultRegistry.Metrics(func(metrics map[string]fmt.Stringer) {
+		varz = NewVarz(metrics)
+	})
+	varz["varz_version"] = VARZ_VERSION
+	varz["server"] = &VarzServer{info, &s.Config().Limits}
+
+	w.Header().Set("Content-Type", "application/json")
+	payload, _ := json.MarshalIndent(varz, "", "  ")
+	w.Write(payload)
+}
+
+func (s *server) flatVarzHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	DefaultRegistry.Metrics(func(metrics map[string]fmt.Stringer) {
 		fmt.Fprintf(w, "{\n")
@@ -338,33 +848,153 @@ func (s *server) varzHandler(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// Lists the connections, sorted by the "sort" parameter and paged with the
+// "offset" and "limit" parameters. Every connection takes its own snapshot
+// from its dispatch loop, those that don't in time are left out.
+func (s *server) connzHandler(w http.ResponseWriter, r *http.Request) {
+	var offset, limit int
+	var err error
+	if value := r.FormValue("offset"); len(value) > 0 {
+		offset, err = strconv.Atoi(value)
+	}
+	if value := r.FormValue("limit"); len(value) > 0 && err == nil {
+		limit, err = strconv.Atoi(value)
+	}
+	if err != nil {
+		http.Error(w, "invalid offset or limit", http.StatusBadRequest)
+		return
+	}
+
+	s.lock.Lock()
+	conns := make([]Conn, 0, len(s.conns))
+	for conn, _ := range s.conns {
+		conns = append(conns, conn)
+	}
+	s.lock.Unlock()
+
+	cmd := &ConnInfoCmd{make(chan *ConnInfo, len(conns))}
+	for _, conn := range conns {
+		go conn.ServeCommand(cmd)
+	}
+
+	infos := make([]*ConnInfo, 0, len(conns))
+	timeout := time.After(CONNZ_TIMEOUT)
+collect:
+	for replies := 0; replies < len(conns); replies++ {
+		select {
+		case info := <-cmd.Info:
+			if info != nil {
+				infos = append(infos, info)
+			}
+		case <-timeout:
+			Log.Warnf("Only %d of %d connections listed in time", replies, len(conns))
+			break collect
+		}
+	}
+
+	connz, err := NewConnz(infos, r.FormValue("sort"), offset, limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	payload, _ := json.MarshalIndent(connz, "", "  ")
+	w.Write(payload)
+}
+
+// Lists the subscriptions with the stats of their tries, paged with the
+// "offset" and "limit" parameters. The "account" parameter restricts them
+// to one account, and the "test" parameter lists the subscriptions a
+// message published on that subject in the account would reach.
+func (s *server) subszHandler(w http.ResponseWriter, r *http.Request) {
+	var offset, limit int
+	var err error
+	if value := r.FormValue("offset"); len(value) > 0 {
+		offset, err = strconv.Atoi(value)
+	}
+	if value := r.FormValue("limit"); len(value) > 0 && err == nil {
+		limit, err = strconv.Atoi(value)
+	}
+	if err != nil {
+		http.Error(w, "invalid offset or limit", http.StatusBadRequest)
+		return
+	}
+
+	cmd := &SubszCmd{Test: r.FormValue("test"), Subsz: make(chan *Subsz, 1)}
+	if name := r.FormValue("account"); len(name) > 0 {
+		cmd.TestAccount = s.accounts[name]
+		if cmd.TestAccount == nil {
+			http.Error(w, fmt.Sprintf("unknown account '%s'", name), http.StatusBadRequest)
+			return
+		}
+		cmd.Accounts = []*Account{cmd.TestAccount}
+	} else {
+		cmd.TestAccount = s.accounts[GLOBAL_ACCOUNT]
+		names := make([]string, 0, len(s.accounts))
+		for name, _ := range s.accounts {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			cmd.Accounts = append(cmd.Accounts, s.accounts[name])
+		}
+	}
+	if len(cmd.Test) > 0 && !ensureValidPublishedSubject(cmd.Test) {
+		http.Error(w, fmt.Sprintf("invalid test subject '%s'", cmd.Test), http.StatusBadRequest)
+		return
+	}
+
+	// A busy server loop times out the request instead of holding it.
+	timeout := time.After(SUBSZ_TIMEOUT)
+	select {
+	case s.commands <- cmd:
+	case <-timeout:
+		http.Error(w, "timed out", http.StatusServiceUnavailable)
+		return
+	}
+
+	var subsz *Subsz
+	select {
+	case subsz = <-cmd.Subsz:
+	case <-timeout:
+		http.Error(w, "timed out", http.StatusServiceUnavailable)
+		return
+	}
+
+	err = subsz.Page(offset, limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	payload, _ := json.MarshalIndent(subsz, "", "  ")
+	w.Write(payload)
+}
+
 type BasicAuthHandler struct {
-	users       map[string]bool
+	users       map[string]string
 	handlerFunc http.HandlerFunc
 }
 
+// Create a handler that requires one of the users, whose passwords are
+// either bcrypt hashes or plain text.
 func NewBasicAuthHandler(users map[string]string, handlerFunc http.HandlerFunc) *BasicAuthHandler {
-	handler := &BasicAuthHandler{handlerFunc: handlerFunc}
-	handler.users = make(map[string]bool)
-	for user, pass := range users {
-		plain := fmt.Sprintf("%s:%s", user, pass)
-		encoded := base64.StdEncoding.EncodeToString([]byte(plain))
-		padded := fmt.Sprintf("Basic %s", encoded)
-		handler.users[padded] = true
-	}
-	return handler
+	return &BasicAuthHandler{users: users, handlerFunc: handlerFunc}
 }
 
 func (h *BasicAuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if len(h.users) > 0 {
-		auth := r.Header.Get("Authorization")
-		if len(auth) > 0 {
-			if h.users[auth] != true {
-				w.Header().Add("WWW-Authenticate", "Basic")
-				http.Error(w, "Unauthorized", http.StatusUnauthorized)
-				return
+		user, password, ok := r.BasicAuth()
+		if ok {
+			configured, found := h.users[user]
+			if !found {
+				configured = DUMMY_PASSWORD_HASH
 			}
-		} else {
+			ok = PasswordMatches(configured, password) && found
+		}
+		if !ok {
 			w.Header().Add("WWW-Authenticate", "Basic")
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
@@ -5,6 +5,7 @@ package gonatsd
 import (
 	"math/rand"
 	"sync/atomic"
+	"time"
 )
 
 type ServerCmd interface {
@@ -18,7 +19,8 @@ type SubscribeCmd struct {
 
 func (cmd *SubscribeCmd) Process(s Server) {
 	subscription := cmd.Subscription
-	s.Subscriptions().Insert(subscription.Subject, subscription)
+	subscription.Account.Subscriptions.Insert(subscription.Subject, subscription)
+	s.Cluster().Subscribed(subscription)
 	cmd.Done <- true
 }
 
@@ -38,22 +40,79 @@ func (cmd *UnsubscribeCmd) Process(s Server) {
 		}
 	}
 
-	s.Subscriptions().Delete(subscription.Subject, subscription)
+	subscription.Account.Subscriptions.Delete(subscription.Subject, subscription)
+	s.Cluster().Unsubscribed(subscription)
 	cmd.Unsubscribed <- true
 }
 
+// Message published in an account, it reaches the subscriptions of that
+// account and of the accounts importing the subject. Publishers that
+// turned echo off don't get their own messages back. Requests that reach
+// no one get a no responders status on their reply subject, if the
+// publisher asked for it. Those options are copied from the publisher when
+// it publishes, the server loop doesn't read them from the conn.
 type PublishCmd struct {
-	Message *Message
+	Message      *Message
+	Account      *Account
+	Conn         Conn // publisher, nil if unknown
+	Echo         bool
+	NoResponders bool
+	Enqueued     time.Time
 }
 
 func (cmd *PublishCmd) Process(s Server) {
 	atomic.AddInt64(&s.Stats().msg_recv, 1)
-	atomic.AddInt64(&s.Stats().bytes_recv, int64(len(cmd.Message.Content)))
+	atomic.AddInt64(&s.Stats().bytes_recv, int64(cmd.Message.Size()))
+	if !cmd.Enqueued.IsZero() {
+		s.Stats().publish_latency.Observe(int64(time.Since(cmd.Enqueued) / time.Microsecond))
+	}
+	s.Stats().payload_size.Observe(int64(cmd.Message.Size()))
+
+	var skip Conn
+	if cmd.Conn != nil && !cmd.Echo {
+		skip = cmd.Conn
+	}
+
+	delivered := deliver(s, cmd.Account, cmd.Message, skip)
+	for _, account := range cmd.Account.Importers(cmd.Message.Subject) {
+		delivered += deliver(s, account, cmd.Message, skip)
+	}
 
+	if delivered == 0 && len(cmd.Message.ReplyTo) > 0 && cmd.Conn != nil && cmd.NoResponders {
+		atomic.AddInt64(&s.Stats().no_responders, 1)
+		deliverNoResponders(s, cmd.Account, cmd.Conn, cmd.Message.ReplyTo)
+	}
+}
+
+// Deliver the no responders status to the requester's subscriptions on the
+// reply subject. Other subscriptions matching it, like wildcards on the
+// inbox prefix, don't get it.
+func deliverNoResponders(s Server, account *Account, requester Conn, replyTo string) {
+	status := &Message{Subject: replyTo, Header: NewStatusHeader(NO_RESPONDERS_STATUS)}
+	for _, match := range account.Subscriptions.Match(replyTo, WildcardMatcher) {
+		subscription := match.(*Subscription)
+		if subscription.Conn == requester {
+			s.DeliverMessage(subscription, status)
+		}
+	}
+}
+
+// Deliver the message to the matching subscriptions of the account, once
+// per queue group. Messages with headers only go to connections that
+// support them, and subscriptions of the skipped connection are left out.
+// Returns the number of deliveries.
+func deliver(s Server, account *Account, message *Message, skip Conn) int {
 	var queueGroups map[string][]*Subscription
+	delivered := 0
 
-	for _, match := range s.Subscriptions().Match(cmd.Message.Subject, WildcardMatcher) {
+	for _, match := range account.Subscriptions.Match(message.Subject, WildcardMatcher) {
 		subscription := match.(*Subscription)
+		if skip != nil && subscription.Conn == skip {
+			continue
+		}
+		if message.Header != nil && !subscription.Headers {
+			continue
+		}
 		if subscription.Queue != nil {
 			if queueGroups == nil {
 				queueGroups = make(map[string][]*Subscription)
@@ -64,16 +123,19 @@ func (cmd *PublishCmd) Process(s Server) {
 			}
 			queueGroups[*subscription.Queue] = append(subscriptions, subscription)
 		} else {
-			s.DeliverMessage(subscription, cmd.Message)
+			s.DeliverMessage(subscription, message)
+			delivered++
 		}
 	}
 
 	if queueGroups != nil {
 		for _, subscriptions := range queueGroups {
 			index := rand.Int31n(int32(len(subscriptions)))
-			s.DeliverMessage(subscriptions[index], cmd.Message)
+			s.DeliverMessage(subscriptions[index], message)
+			delivered++
 		}
 	}
+	return delivered
 }
 
 type UnregisterConnCmd struct {
@@ -83,7 +145,62 @@ type UnregisterConnCmd struct {
 
 func (cmd *UnregisterConnCmd) Process(s Server) {
 	for _, subscription := range cmd.Conn.Subscriptions() {
-		s.Subscriptions().Delete(subscription.Subject, subscription)
+		subscription.Account.Subscriptions.Delete(subscription.Subject, subscription)
+		s.Cluster().Unsubscribed(subscription)
+	}
+	if cmd.Conn.Route() != nil {
+		s.Cluster().Unregister(cmd.Conn)
 	}
 	cmd.Done <- true
 }
+
+// Register a route, along with the SUBs it has to send for the local
+// subscriptions. The route writes them itself once it's registered.
+type RegisterRouteCmd struct {
+	Conn       Conn
+	Registered chan bool
+	Interest   []*Response
+}
+
+func (cmd *RegisterRouteCmd) Process(s Server) {
+	registered := s.Cluster().Register(cmd.Conn)
+	if registered {
+		cmd.Interest = s.Cluster().Interest()
+	}
+	cmd.Registered <- registered
+}
+
+// Message from another server in the cluster, it has already been matched
+// there so it's delivered straight to the local subscription.
+type RoutedMessageCmd struct {
+	SubscriptionId int
+	Message        *Message
+}
+
+func (cmd *RoutedMessageCmd) Process(s Server) {
+	atomic.AddInt64(&s.Stats().msg_recv, 1)
+	atomic.AddInt64(&s.Stats().bytes_recv, int64(cmd.Message.Size()))
+
+	subscription := s.Cluster().Subscription(cmd.SubscriptionId)
+	if subscription != nil && (cmd.Message.Header == nil || subscription.Headers) {
+		s.DeliverMessage(subscription, cmd.Message)
+	}
+}
+
+// Snapshot of the subscriptions of the accounts for /subsz, taken on the
+// server loop so the tries are not modified meanwhile. The test subject, if
+// any, is matched as if it was published in the test account.
+type SubszCmd struct {
+	Accounts    []*Account
+	TestAccount *Account
+	Test        string
+	Subsz       chan *Subsz
+}
+
+func (cmd *SubszCmd) Process(s Server) {
+	subsz := NewSubsz(cmd.Accounts)
+	if len(cmd.Test) > 0 {
+		subsz.Match(cmd.TestAccount, cmd.Test)
+	}
+	cmd.Subsz <- subsz
+}
@@ -0,0 +1,115 @@
+// Copyright (c) 2012 VMware, Inc.
+
+package gonatsd_test
+
+import (
+	"code.google.com/p/gomock/gomock"
+	. "gonatsd/gonatsd"
+	. "gonatsd/gonatsd/mocks"
+	. "launchpad.net/gocheck"
+)
+
+type ServerCmdSuite struct{}
+
+var _ = Suite(&ServerCmdSuite{})
+
+func (s *ServerCmdSuite) TestPublishCmdHeaders(c *C) {
+	ctrl := gomock.NewController(c)
+	defer ctrl.Finish()
+
+	account := NewAccount(GLOBAL_ACCOUNT)
+	subscribe := func(headers bool) *Subscription {
+		subscription := &Subscription{Subject: "foo", Conn: NewMockConn(ctrl), Account: account, Headers: headers}
+		account.Subscriptions.Insert("foo", subscription)
+		return subscription
+	}
+	supported := subscribe(true)
+	subscribe(false)
+
+	header, _ := ParseHeader([]byte("NATS/1.0\r\nA: b\r\n\r\n"))
+	message := &Message{Subject: "foo", Header: header}
+	server := NewMockServer(ctrl)
+	server.EXPECT().Stats().Return(NewStats()).AnyTimes()
+	server.EXPECT().DeliverMessage(supported, message)
+
+	(&PublishCmd{Message: message, Account: account}).Process(server)
+}
+
+func (s *ServerCmdSuite) TestPublishCmdNoResponders(c *C) {
+	ctrl := gomock.NewController(c)
+	defer ctrl.Finish()
+
+	account := NewAccount(GLOBAL_ACCOUNT)
+	requester := NewMockConn(ctrl)
+	inbox := &Subscription{Subject: "inbox", Conn: requester, Account: account, Headers: true}
+	account.Subscriptions.Insert("inbox", inbox)
+
+	server := NewMockServer(ctrl)
+	server.EXPECT().Stats().Return(NewStats()).AnyTimes()
+	server.EXPECT().DeliverMessage(inbox, gomock.Any()).Do(func(subscription *Subscription, message *Message) {
+		c.Check(message.Subject, Equals, "inbox")
+		c.Check(message.Header.Status, Equals, NO_RESPONDERS_STATUS)
+		c.Check(string(message.Header.Raw), Equals, "NATS/1.0 503\r\n\r\n")
+		c.Check(message.Content, HasLen, 0)
+	})
+
+	request := &Message{Subject: "service", ReplyTo: "inbox"}
+	(&PublishCmd{Message: request, Account: account, Conn: requester, NoResponders: true}).Process(server)
+
+	// Not without a reply subject, nor for publishers that didn't ask for it
+	(&PublishCmd{Message: &Message{Subject: "service"}, Account: account, Conn: requester,
+		NoResponders: true}).Process(server)
+	(&PublishCmd{Message: request, Account: account, Conn: requester}).Process(server)
+}
+
+func (s *ServerCmdSuite) TestPublishCmdNoRespondersOnlyRequester(c *C) {
+	ctrl := gomock.NewController(c)
+	defer ctrl.Finish()
+
+	account := NewAccount(GLOBAL_ACCOUNT)
+	requester := NewMockConn(ctrl)
+	inbox := &Subscription{Subject: "_INBOX.1", Conn: requester, Account: account, Headers: true}
+	account.Subscriptions.Insert("_INBOX.1", inbox)
+
+	observer := NewMockConn(ctrl)
+	account.Subscriptions.Insert("_INBOX.>", &Subscription{Subject: "_INBOX.>", Conn: observer, Account: account,
+		Headers: true})
+	account.Subscriptions.Insert("_INBOX.*", &Subscription{Subject: "_INBOX.*", Conn: observer, Account: account,
+		Headers: true})
+
+	// Only the requester's inbox gets the status, the wildcards don't
+	server := NewMockServer(ctrl)
+	server.EXPECT().Stats().Return(NewStats()).AnyTimes()
+	server.EXPECT().DeliverMessage(inbox, gomock.Any()).Do(func(subscription *Subscription, message *Message) {
+		c.Check(message.Header.Status, Equals, NO_RESPONDERS_STATUS)
+	})
+
+	request := &Message{Subject: "service", ReplyTo: "_INBOX.1"}
+	(&PublishCmd{Message: request, Account: account, Conn: requester, NoResponders: true}).Process(server)
+}
+
+func (s *ServerCmdSuite) TestPublishCmdNoEcho(c *C) {
+	ctrl := gomock.NewController(c)
+	defer ctrl.Finish()
+
+	account := NewAccount(GLOBAL_ACCOUNT)
+	queue := "q"
+	publisher := NewMockConn(ctrl)
+	own := &Subscription{Subject: "foo", Conn: publisher, Account: account}
+	ownQueue := &Subscription{Subject: "foo", Queue: &queue, Conn: publisher, Account: account}
+	account.Subscriptions.Insert("foo", own)
+	account.Subscriptions.Insert("foo", ownQueue)
+
+	other := &Subscription{Subject: "foo", Conn: NewMockConn(ctrl), Account: account}
+	account.Subscriptions.Insert("foo", other)
+
+	message := &Message{Subject: "foo", Content: []byte("bar")}
+	server := NewMockServer(ctrl)
+	server.EXPECT().Stats().Return(NewStats()).AnyTimes()
+	server.EXPECT().DeliverMessage(other, message).Times(2)
+	server.EXPECT().DeliverMessage(own, message)
+	server.EXPECT().DeliverMessage(ownQueue, message)
+
+	(&PublishCmd{Message: message, Account: account, Conn: publisher, Echo: false}).Process(server)
+	(&PublishCmd{Message: message, Account: account, Conn: publisher, Echo: true}).Process(server)
+}
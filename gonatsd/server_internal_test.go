@@ -0,0 +1,207 @@
+// Copyright (c) 2012 VMware, Inc.
+
+package gonatsd
+
+import (
+	"fmt"
+	. "launchpad.net/gocheck"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"time"
+)
+
+type ServerInternalSuite struct{}
+
+var _ = Suite(&ServerInternalSuite{})
+
+// Client conn that only takes commands, its backlog is full once the
+// channel is.
+type commandConn struct {
+	Conn
+	commands chan ClientCmd
+	pending  int64
+}
+
+func newCommandConn(backlog int) *commandConn {
+	return &commandConn{commands: make(chan ClientCmd, backlog)}
+}
+
+func (c *commandConn) Route() *Route {
+	return nil
+}
+
+func (c *commandConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+}
+
+func (c *commandConn) Pending() int {
+	return int(atomic.LoadInt64(&c.pending))
+}
+
+func (c *commandConn) ServeCommand(cmd ClientCmd) {
+	c.commands <- cmd
+}
+
+func (c *commandConn) TryServeCommand(cmd ClientCmd) bool {
+	select {
+	case c.commands <- cmd:
+		return true
+	default:
+		return false
+	}
+}
+
+func newTestServer(c *C, conns ...Conn) *server {
+	created, err := NewServer(&Config{})
+	c.Assert(err, IsNil)
+	server := created.(*server)
+	for _, conn := range conns {
+		server.conns[conn] = true
+	}
+	return server
+}
+
+func (s *ServerInternalSuite) TestUpdateInfoFullBacklog(c *C) {
+	full, ready := newCommandConn(0), newCommandConn(2)
+	server := newTestServer(c, full, ready)
+
+	// The full conn is skipped instead of holding up the others
+	server.UpdateInfo(func(info *Info) {
+		info.MaxPayload = 42
+	})
+	c.Check(<-ready.commands, Equals, INFO_UPDATE_CMD)
+
+	// Nothing is pushed when the INFO didn't change
+	server.UpdateInfo(func(info *Info) {
+		info.MaxPayload = 42
+	})
+	c.Check(ready.commands, HasLen, 0)
+}
+
+func (s *ServerInternalSuite) TestLameDuckFullBacklog(c *C) {
+	full, ready := newCommandConn(0), newCommandConn(4)
+	server := newTestServer(c, full, ready)
+
+	done := make(chan bool)
+	go func() {
+		server.LameDuck(10 * time.Millisecond)
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		c.Fatalf("Lame duck mode held up by a full client")
+	}
+	c.Check(<-ready.commands, Equals, INFO_UPDATE_CMD)
+	c.Check(<-ready.commands, DeepEquals, &CloseWithErrorCmd{ErrServerLameDuck})
+}
+
+func (s *ServerInternalSuite) TestRoutesMetricIsGauge(c *C) {
+	server := newTestServer(c)
+	server.bindMetrics()
+
+	server.cluster.routeCount = 2
+	DefaultRegistry.Metrics(func(metrics map[string]fmt.Stringer) {
+		metric := metrics["cluster.routes"]
+		c.Check(metric, FitsTypeOf, &Gauge{})
+		c.Check(metric.String(), Equals, "2")
+	})
+}
+
+func (s *ServerInternalSuite) TestReloadFullBacklog(c *C) {
+	full, ready := newCommandConn(0), newCommandConn(4)
+	server := newTestServer(c, full, ready)
+
+	done := make(chan bool)
+	go func() {
+		server.Reload(&Config{})
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		c.Fatalf("Reload held up by a full client")
+	}
+	c.Check(<-ready.commands, Equals, INFO_UPDATE_CMD)
+	c.Check(<-ready.commands, FitsTypeOf, &ReloadAuthCmd{})
+}
+
+// Runs Shutdown in the background and returns a channel that is closed
+// once it returned.
+func startShutdown(server *server, timeout time.Duration) chan bool {
+	done := make(chan bool)
+	go func() {
+		server.Shutdown(timeout)
+		close(done)
+	}()
+	return done
+}
+
+func (s *ServerInternalSuite) TestShutdown(c *C) {
+	conn := newCommandConn(1)
+	conn.pending = 2
+	server := newTestServer(c, conn)
+	server.connsDone.Add(1)
+
+	done := startShutdown(server, 5*time.Second)
+
+	// The conn is closed only once its pending writes are flushed
+	time.Sleep(5 * DRAIN_POLL_INTERVAL)
+	c.Check(conn.commands, HasLen, 0)
+	atomic.StoreInt64(&conn.pending, 0)
+	c.Check(<-conn.commands, DeepEquals, &CloseWithErrorCmd{ErrServerShutdown})
+
+	select {
+	case <-done:
+		c.Fatalf("Shutdown returned before the conn was closed")
+	case <-time.After(5 * DRAIN_POLL_INTERVAL):
+	}
+	server.connsDone.Done()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		c.Fatalf("Shutdown didn't return once the conn was closed")
+	}
+	c.Check(server.isShuttingDown(), Equals, true)
+	_, open := <-server.done
+	c.Check(open, Equals, false)
+}
+
+func (s *ServerInternalSuite) TestShutdownTimeout(c *C) {
+	conn := newCommandConn(1)
+	conn.pending = 2
+	server := newTestServer(c, conn)
+	server.connsDone.Add(1)
+
+	// The conn never flushes nor goes away
+	done := startShutdown(server, 50*time.Millisecond)
+
+	c.Check(<-conn.commands, DeepEquals, &CloseWithErrorCmd{ErrServerShutdown})
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		c.Fatalf("Shutdown didn't stop after the timeout")
+	}
+	_, open := <-server.done
+	c.Check(open, Equals, false)
+}
+
+func (s *ServerInternalSuite) TestSubszBusyServer(c *C) {
+	server := newTestServer(c)
+	// Nothing serves the commands, as if the server loop was stuck
+	server.commands = make(chan ServerCmd)
+
+	recorder := httptest.NewRecorder()
+	request, err := http.NewRequest("GET", "/subsz", nil)
+	c.Assert(err, IsNil)
+
+	started := time.Now()
+	server.subszHandler(recorder, request)
+	c.Check(recorder.Code, Equals, http.StatusServiceUnavailable)
+	c.Check(time.Since(started) < 2*SUBSZ_TIMEOUT, Equals, true)
+}
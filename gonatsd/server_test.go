@@ -0,0 +1,92 @@
+// Copyright (c) 2012 VMware, Inc.
+
+package gonatsd_test
+
+import (
+	"code.google.com/p/gomock/gomock"
+	"encoding/json"
+	. "gonatsd/gonatsd"
+	. "gonatsd/gonatsd/mocks"
+	. "launchpad.net/gocheck"
+	"net/http"
+	"net/http/httptest"
+)
+
+type BasicAuthHandlerSuite struct{}
+
+var _ = Suite(&BasicAuthHandlerSuite{})
+
+func (s *BasicAuthHandlerSuite) serve(handler http.Handler, user, password string) int {
+	request, _ := http.NewRequest("GET", "/varz", nil)
+	if len(user) > 0 {
+		request.SetBasicAuth(user, password)
+	}
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	return recorder.Code
+}
+
+func (s *BasicAuthHandlerSuite) TestAuth(c *C) {
+	hash, err := HashPassword("secret", 4)
+	c.Assert(err, IsNil)
+
+	handler := NewBasicAuthHandler(map[string]string{"foo": "bar", "baz": hash},
+		func(w http.ResponseWriter, r *http.Request) {})
+
+	c.Check(s.serve(handler, "foo", "bar"), Equals, http.StatusOK)
+	c.Check(s.serve(handler, "baz", "secret"), Equals, http.StatusOK)
+	c.Check(s.serve(handler, "baz", "bar"), Equals, http.StatusUnauthorized)
+	c.Check(s.serve(handler, "qux", "bar"), Equals, http.StatusUnauthorized)
+	c.Check(s.serve(handler, "", ""), Equals, http.StatusUnauthorized)
+}
+
+func (s *BasicAuthHandlerSuite) TestUnknownUser(c *C) {
+	c.Check(IsPasswordHash(DUMMY_PASSWORD_HASH), Equals, true)
+	c.Check(PasswordMatches(DUMMY_PASSWORD_HASH, "gonatsd-unknown-user"), Equals, true)
+
+	// Unknown users are checked against the dummy hash but never allowed
+	handler := NewBasicAuthHandler(map[string]string{"foo": "bar"}, func(w http.ResponseWriter, r *http.Request) {})
+	c.Check(s.serve(handler, "qux", "gonatsd-unknown-user"), Equals, http.StatusUnauthorized)
+}
+
+func (s *BasicAuthHandlerSuite) TestNoUsers(c *C) {
+	handler := NewBasicAuthHandler(map[string]string{}, func(w http.ResponseWriter, r *http.Request) {})
+	c.Check(s.serve(handler, "", ""), Equals, http.StatusOK)
+}
+
+type ServerSuite struct{}
+
+var _ = Suite(&ServerSuite{})
+
+func (s *ServerSuite) TestRegisterUser(c *C) {
+	ctrl := gomock.NewController(c)
+	defer ctrl.Finish()
+
+	config := &Config{}
+	config.Limits.UserConnections = 2
+	server, err := NewServer(config)
+	c.Assert(err, IsNil)
+
+	first, second := NewMockConn(ctrl), NewMockConn(ctrl)
+	c.Check(server.RegisterUser(first, "foo"), Equals, true)
+	c.Check(server.RegisterUser(first, "foo"), Equals, true)
+	c.Check(server.RegisterUser(second, "foo"), Equals, true)
+	c.Check(server.RegisterUser(NewMockConn(ctrl), "foo"), Equals, false)
+	c.Check(server.RegisterUser(NewMockConn(ctrl), "bar"), Equals, true)
+	c.Check(server.RegisterUser(NewMockConn(ctrl), ""), Equals, true)
+}
+
+func (s *ServerSuite) TestUpdateInfo(c *C) {
+	server, err := NewServer(&Config{})
+	c.Assert(err, IsNil)
+
+	server.UpdateInfo(func(info *Info) {
+		info.MaxPayload = 42
+		info.LameDuckMode = true
+	})
+
+	info := &Info{}
+	c.Assert(json.Unmarshal(*server.Info(), info), IsNil)
+	c.Check(info.MaxPayload, Equals, 42)
+	c.Check(info.LameDuckMode, Equals, true)
+}
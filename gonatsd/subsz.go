@@ -0,0 +1,101 @@
+// Copyright (c) 2012 VMware, Inc.
+
+package gonatsd
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	DEFAULT_SUBSZ_LIMIT = 1024
+	SUBSZ_TIMEOUT       = 2 * time.Second
+)
+
+// Snapshot of a subscription for /subsz.
+type SubscriptionInfo struct {
+	Account string `json:"account"`
+	Subject string `json:"subject"`
+	Queue   string `json:"queue,omitempty"`
+	Sid     int    `json:"sid"`
+	Cid     uint64 `json:"cid"`
+}
+
+func newSubscriptionInfo(subscription *Subscription) *SubscriptionInfo {
+	info := &SubscriptionInfo{Account: subscription.Account.Name, Subject: subscription.Subject,
+		Sid: subscription.Id, Cid: subscription.Conn.Id()}
+	if subscription.Queue != nil {
+		info.Queue = *subscription.Queue
+	}
+	return info
+}
+
+// Subscriptions a message published on the subject would be delivered to.
+// Every member of a queue group is listed, although only one would get it.
+type SubszTest struct {
+	Account string              `json:"account"`
+	Subject string              `json:"subject"`
+	Matches []*SubscriptionInfo `json:"matches"`
+}
+
+// Snapshot of the subscription tries, with a page of their subscriptions
+// ordered by account and subject.
+type Subsz struct {
+	Now           time.Time             `json:"now"`
+	Stats         map[string]*TrieStats `json:"stats"` // account -> trie stats
+	Total         int                   `json:"total"`
+	Offset        int                   `json:"offset"`
+	Limit         int                   `json:"limit"`
+	Subscriptions []*SubscriptionInfo   `json:"subscriptions"`
+	Test          *SubszTest            `json:"test,omitempty"`
+}
+
+// Take a snapshot of the subscriptions of the accounts.
+// Must be called from the server loop.
+func NewSubsz(accounts []*Account) *Subsz {
+	subsz := &Subsz{Now: time.Now().UTC(), Stats: make(map[string]*TrieStats),
+		Subscriptions: make([]*SubscriptionInfo, 0, 16)}
+	for _, account := range accounts {
+		subsz.Stats[account.Name] = account.Subscriptions.Stats()
+		account.Subscriptions.Walk(func(subject string, value interface{}) {
+			subsz.Subscriptions = append(subsz.Subscriptions, newSubscriptionInfo(value.(*Subscription)))
+		})
+	}
+	subsz.Total = len(subsz.Subscriptions)
+	return subsz
+}
+
+// Match the subject as if it was published in the account, in which case
+// the accounts importing it are matched too.
+// Must be called from the server loop.
+func (s *Subsz) Match(account *Account, subject string) {
+	s.Test = &SubszTest{Account: account.Name, Subject: subject, Matches: make([]*SubscriptionInfo, 0, 1)}
+	accounts := append([]*Account{account}, account.Importers(subject)...)
+	for _, account := range accounts {
+		for _, match := range account.Subscriptions.Match(subject, WildcardMatcher) {
+			s.Test.Matches = append(s.Test.Matches, newSubscriptionInfo(match.(*Subscription)))
+		}
+	}
+}
+
+// Keep only the requested page of subscriptions, a limit of 0 means the
+// default limit.
+func (s *Subsz) Page(offset, limit int) error {
+	if offset < 0 || limit < 0 {
+		return fmt.Errorf("invalid offset or limit")
+	}
+	if limit == 0 {
+		limit = DEFAULT_SUBSZ_LIMIT
+	}
+
+	s.Offset, s.Limit = offset, limit
+	if offset > len(s.Subscriptions) {
+		offset = len(s.Subscriptions)
+	}
+	end := offset + limit
+	if end > len(s.Subscriptions) {
+		end = len(s.Subscriptions)
+	}
+	s.Subscriptions = s.Subscriptions[offset:end]
+	return nil
+}
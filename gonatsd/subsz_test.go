@@ -0,0 +1,95 @@
+// Copyright (c) 2012 VMware, Inc.
+
+package gonatsd_test
+
+import (
+	"code.google.com/p/gomock/gomock"
+	. "gonatsd/gonatsd"
+	. "gonatsd/gonatsd/mocks"
+	. "launchpad.net/gocheck"
+)
+
+type SubszSuite struct{}
+
+var _ = Suite(&SubszSuite{})
+
+func newTestSubsz(c *C, ctrl *gomock.Controller) (map[string]*Account, *SubszCmd) {
+	accounts := newTestAccounts(c)
+	conn := NewMockConn(ctrl)
+	conn.EXPECT().Id().Return(uint64(7)).AnyTimes()
+
+	queue := "workers"
+	subscriptions := []*Subscription{
+		&Subscription{Id: 1, Subject: "public.foo", Account: accounts["a"]},
+		&Subscription{Id: 2, Subject: "public.*", Account: accounts["b"], Queue: &queue},
+		&Subscription{Id: 3, Subject: "private", Account: accounts["a"]},
+		&Subscription{Id: 4, Subject: "public.foo", Account: accounts[GLOBAL_ACCOUNT]},
+	}
+	for _, subscription := range subscriptions {
+		subscription.Conn = conn
+		subscription.Account.Subscriptions.Insert(subscription.Subject, subscription)
+	}
+
+	cmd := &SubszCmd{Accounts: []*Account{accounts["a"], accounts["b"]}, Subsz: make(chan *Subsz, 1)}
+	return accounts, cmd
+}
+
+func subszSids(infos []*SubscriptionInfo) []int {
+	sids := make([]int, 0, len(infos))
+	for _, info := range infos {
+		sids = append(sids, info.Sid)
+	}
+	return sids
+}
+
+func (s *SubszSuite) TestSubszCmd(c *C) {
+	ctrl := gomock.NewController(c)
+	defer ctrl.Finish()
+
+	_, cmd := newTestSubsz(c, ctrl)
+	cmd.Process(NewMockServer(ctrl))
+	subsz := <-cmd.Subsz
+
+	c.Check(subsz.Total, Equals, 3)
+	c.Check(subszSids(subsz.Subscriptions), DeepEquals, []int{3, 1, 2})
+	c.Check(*subsz.Subscriptions[2], DeepEquals,
+		SubscriptionInfo{Account: "b", Subject: "public.*", Queue: "workers", Sid: 2, Cid: 7})
+	c.Check(subsz.Stats, HasLen, 2)
+	c.Check(subsz.Stats["a"].Values, Equals, 2)
+	c.Check(subsz.Stats["b"].Depth, Equals, 2)
+	c.Check(subsz.Test, IsNil)
+}
+
+func (s *SubszSuite) TestSubszCmdMatch(c *C) {
+	ctrl := gomock.NewController(c)
+	defer ctrl.Finish()
+
+	accounts, cmd := newTestSubsz(c, ctrl)
+	cmd.TestAccount, cmd.Test = accounts["a"], "public.foo"
+	cmd.Process(NewMockServer(ctrl))
+	subsz := <-cmd.Subsz
+	c.Assert(subsz.Test, NotNil)
+	c.Check(subszSids(subsz.Test.Matches), DeepEquals, []int{1, 2})
+
+	cmd.TestAccount, cmd.Test = accounts[GLOBAL_ACCOUNT], "private"
+	cmd.Process(NewMockServer(ctrl))
+	subsz = <-cmd.Subsz
+	c.Check(subsz.Test.Matches, HasLen, 0)
+}
+
+func (s *SubszSuite) TestPage(c *C) {
+	ctrl := gomock.NewController(c)
+	defer ctrl.Finish()
+
+	_, cmd := newTestSubsz(c, ctrl)
+	cmd.Process(NewMockServer(ctrl))
+	subsz := <-cmd.Subsz
+
+	c.Check(subsz.Page(1, 1), IsNil)
+	c.Check(subszSids(subsz.Subscriptions), DeepEquals, []int{1})
+	c.Check(subsz.Total, Equals, 3)
+	c.Check(subsz.Page(5, 0), IsNil)
+	c.Check(subsz.Subscriptions, HasLen, 0)
+	c.Check(subsz.Limit, Equals, DEFAULT_SUBSZ_LIMIT)
+	c.Check(subsz.Page(-1, 0), NotNil)
+}
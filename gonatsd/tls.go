@@ -0,0 +1,112 @@
+// Copyright (c) 2012 VMware, Inc.
+
+package gonatsd
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"time"
+)
+
+// Map of accepted TLS min_version values.
+var TLS_VERSIONS = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Create the TLS configuration for the client listener.
+func NewTLSConfig(config *TLSConfig) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(config.Cert, config.Key)
+	if err != nil {
+		return nil, fmt.Errorf("can't load certificate '%s': %s", config.Cert, err.Error())
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if len(config.MinVersion) > 0 {
+		version, ok := TLS_VERSIONS[config.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown TLS version '%s'", config.MinVersion)
+		}
+		tlsConfig.MinVersion = version
+	}
+
+	if len(config.Ciphers) > 0 {
+		suites := make(map[string]uint16)
+		for _, suite := range tls.CipherSuites() {
+			suites[suite.Name] = suite.ID
+		}
+
+		tlsConfig.CipherSuites = make([]uint16, 0, len(config.Ciphers))
+		for _, name := range config.Ciphers {
+			id, ok := suites[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown or insecure cipher '%s'", name)
+			}
+			tlsConfig.CipherSuites = append(tlsConfig.CipherSuites, id)
+		}
+	}
+
+	if len(config.CA) > 0 {
+		pem, err := ioutil.ReadFile(config.CA)
+		if err != nil {
+			return nil, fmt.Errorf("can't load CA '%s': %s", config.CA, err.Error())
+		}
+
+		tlsConfig.ClientCAs = x509.NewCertPool()
+		if !tlsConfig.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA '%s'", config.CA)
+		}
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		if config.Verify {
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	} else if config.Verify {
+		return nil, errors.New("verify requires a ca")
+	}
+
+	return tlsConfig, nil
+}
+
+// TLS connection that can still be half closed like the underlying
+// TCP connection.
+type TLSConn struct {
+	*tls.Conn
+	tc TCPConn
+}
+
+// Wrap the TCP connection with the server side of TLS.
+func NewTLSConn(tc TCPConn, config *tls.Config) *TLSConn {
+	return &TLSConn{tls.Server(tc, config), tc}
+}
+
+// Performs the TLS handshake, giving up after the timeout.
+func (c *TLSConn) HandshakeWithTimeout(timeout time.Duration) error {
+	if timeout > 0 {
+		c.SetDeadline(time.Now().Add(timeout))
+		defer c.SetDeadline(time.Time{})
+	}
+	return c.Handshake()
+}
+
+// Returns the client certificates iff they were verified during the handshake.
+func (c *TLSConn) VerifiedCertificates() []*x509.Certificate {
+	state := c.ConnectionState()
+	if len(state.VerifiedChains) == 0 {
+		return nil
+	}
+	return state.PeerCertificates
+}
+
+// CloseRead implements the TCPConn CloseRead method.
+func (c *TLSConn) CloseRead() error {
+	return c.tc.CloseRead()
+}
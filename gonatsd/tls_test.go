@@ -0,0 +1,205 @@
+// Copyright (c) 2012 VMware, Inc.
+
+package gonatsd_test
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	. "gonatsd/gonatsd"
+	"io"
+	. "launchpad.net/gocheck"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+type TLSSuite struct {
+	dir    string
+	ca     *testCert
+	server *testCert
+}
+
+var _ = Suite(&TLSSuite{})
+
+// Certificate and key generated for testing, along with the PEM files.
+type testCert struct {
+	cert     *x509.Certificate
+	key      *ecdsa.PrivateKey
+	certFile string
+	keyFile  string
+}
+
+// Generates a certificate for the common name signed by the parent, or a
+// self signed CA if the parent is nil.
+func newTestCert(c *C, dir, cn string, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     []string{cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	c.Assert(err, IsNil)
+	cert, err := x509.ParseCertificate(der)
+	c.Assert(err, IsNil)
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	c.Assert(err, IsNil)
+
+	result := &testCert{cert: cert, key: key}
+	result.certFile = filepath.Join(dir, cn+".crt")
+	result.keyFile = filepath.Join(dir, cn+".key")
+	writePEM(c, result.certFile, "CERTIFICATE", der)
+	writePEM(c, result.keyFile, "EC PRIVATE KEY", keyDer)
+	return result
+}
+
+func writePEM(c *C, filename, kind string, der []byte) {
+	file, err := os.Create(filename)
+	c.Assert(err, IsNil)
+	defer file.Close()
+	c.Assert(pem.Encode(file, &pem.Block{Type: kind, Bytes: der}), IsNil)
+}
+
+func (t *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{t.cert.Raw}, PrivateKey: t.key}
+}
+
+func (s *TLSSuite) SetUpSuite(c *C) {
+	s.dir = c.MkDir()
+	s.ca = newTestCert(c, s.dir, "ca", nil)
+	s.server = newTestCert(c, s.dir, "localhost", s.ca)
+}
+
+func (s *TLSSuite) TestConfig(c *C) {
+	config, err := NewTLSConfig(&TLSConfig{Cert: s.server.certFile, Key: s.server.keyFile})
+	c.Check(err, IsNil)
+	c.Check(config.Certificates, HasLen, 1)
+	c.Check(config.MinVersion, Equals, uint16(tls.VersionTLS12))
+	c.Check(config.ClientAuth, Equals, tls.NoClientCert)
+}
+
+func (s *TLSSuite) TestConfigMissingCert(c *C) {
+	_, err := NewTLSConfig(&TLSConfig{Cert: "missing.crt", Key: "missing.key"})
+	c.Check(err, NotNil)
+}
+
+func (s *TLSSuite) TestConfigMinVersion(c *C) {
+	config, err := NewTLSConfig(&TLSConfig{Cert: s.server.certFile, Key: s.server.keyFile,
+		MinVersion: "1.3"})
+	c.Check(err, IsNil)
+	c.Check(config.MinVersion, Equals, uint16(tls.VersionTLS13))
+
+	_, err = NewTLSConfig(&TLSConfig{Cert: s.server.certFile, Key: s.server.keyFile, MinVersion: "3.0"})
+	c.Check(err, ErrorMatches, "unknown TLS version '3.0'")
+}
+
+func (s *TLSSuite) TestConfigCiphers(c *C) {
+	config, err := NewTLSConfig(&TLSConfig{Cert: s.server.certFile, Key: s.server.keyFile,
+		Ciphers: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"}})
+	c.Check(err, IsNil)
+	c.Check(config.CipherSuites, DeepEquals, []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256})
+
+	_, err = NewTLSConfig(&TLSConfig{Cert: s.server.certFile, Key: s.server.keyFile,
+		Ciphers: []string{"TLS_RSA_WITH_RC4_128_SHA"}})
+	c.Check(err, ErrorMatches, "unknown or insecure cipher 'TLS_RSA_WITH_RC4_128_SHA'")
+}
+
+func (s *TLSSuite) TestConfigCA(c *C) {
+	config, err := NewTLSConfig(&TLSConfig{Cert: s.server.certFile, Key: s.server.keyFile,
+		CA: s.ca.certFile})
+	c.Check(err, IsNil)
+	c.Check(config.ClientCAs, NotNil)
+	c.Check(config.ClientAuth, Equals, tls.VerifyClientCertIfGiven)
+
+	_, err = NewTLSConfig(&TLSConfig{Cert: s.server.certFile, Key: s.server.keyFile,
+		CA: s.server.keyFile})
+	c.Check(err, NotNil)
+}
+
+func (s *TLSSuite) TestConfigVerify(c *C) {
+	config, err := NewTLSConfig(&TLSConfig{Cert: s.server.certFile, Key: s.server.keyFile,
+		CA: s.ca.certFile, Verify: true})
+	c.Check(err, IsNil)
+	c.Check(config.ClientAuth, Equals, tls.RequireAndVerifyClientCert)
+
+	_, err = NewTLSConfig(&TLSConfig{Cert: s.server.certFile, Key: s.server.keyFile, Verify: true})
+	c.Check(err, ErrorMatches, "verify requires a ca")
+}
+
+func (s *TLSSuite) TestHandshake(c *C) {
+	config, err := NewTLSConfig(&TLSConfig{Cert: s.server.certFile, Key: s.server.keyFile})
+	c.Assert(err, IsNil)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(s.ca.cert)
+
+	tcpConn := NewDummyTCPConn()
+	conn := NewTLSConn(tcpConn, config)
+
+	go func() {
+		client := tls.Client(tcpConn.client, &tls.Config{RootCAs: roots, ServerName: "localhost"})
+		io.WriteString(client, "PING\r\n")
+	}()
+
+	c.Assert(conn.HandshakeWithTimeout(time.Second), IsNil)
+	checkReadLine(c, bufio.NewReader(conn), "PING")
+
+	conn.CloseRead()
+	_, err = conn.Read(make([]byte, 1))
+	c.Check(err, Equals, io.EOF)
+}
+
+func (s *TLSSuite) TestHandshakeClientCert(c *C) {
+	config, err := NewTLSConfig(&TLSConfig{Cert: s.server.certFile, Key: s.server.keyFile,
+		CA: s.ca.certFile, Verify: true})
+	c.Assert(err, IsNil)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(s.ca.cert)
+	client := newTestCert(c, s.dir, "client.example.com", s.ca)
+
+	tcpConn := NewDummyTCPConn()
+	conn := NewTLSConn(tcpConn, config)
+	c.Check(conn.VerifiedCertificates(), IsNil)
+
+	go func() {
+		tls.Client(tcpConn.client, &tls.Config{RootCAs: roots, ServerName: "localhost",
+			Certificates: []tls.Certificate{client.tlsCertificate()}}).Handshake()
+	}()
+
+	c.Assert(conn.HandshakeWithTimeout(time.Second), IsNil)
+	certs := conn.VerifiedCertificates()
+	c.Assert(certs, HasLen, 1)
+	c.Check(certs[0].Subject.CommonName, Equals, "client.example.com")
+}
+
+func (s *TLSSuite) TestHandshakeTimeout(c *C) {
+	config, err := NewTLSConfig(&TLSConfig{Cert: s.server.certFile, Key: s.server.keyFile})
+	c.Assert(err, IsNil)
+
+	conn := NewTLSConn(NewDummyTCPConn(), config)
+	c.Check(conn.HandshakeWithTimeout(10*time.Millisecond), NotNil)
+}
@@ -3,6 +3,8 @@
 package gonatsd
 
 import (
+	"fmt"
+	"sort"
 	"strings"
 )
 
@@ -97,6 +99,67 @@ func (t *Trie) Values() int {
 	return t.values
 }
 
+// Shape of a trie. The fan-out histogram counts the nodes by their number
+// of children, bucketed by powers of two: "0", "1", "2-3", "4-7"...
+type TrieStats struct {
+	Nodes  int            `json:"nodes"`
+	Values int            `json:"values"`
+	Depth  int            `json:"depth"`
+	FanOut map[string]int `json:"fan_out"`
+}
+
+// Compute the stats of the trie, walking all of its nodes.
+func (t *Trie) Stats() *TrieStats {
+	stats := &TrieStats{Nodes: t.nodes, Values: t.values, FanOut: make(map[string]int)}
+	t.root.stats(stats, 0)
+	return stats
+}
+
+func (n *trieNode) stats(stats *TrieStats, depth int) {
+	if depth > stats.Depth {
+		stats.Depth = depth
+	}
+	stats.FanOut[fanOutBucket(len(n.Children))]++
+	for _, child := range n.Children {
+		child.stats(stats, depth+1)
+	}
+}
+
+func fanOutBucket(children int) string {
+	if children < 2 {
+		return fmt.Sprint(children)
+	}
+	low := 2
+	for low*2 <= children {
+		low *= 2
+	}
+	return fmt.Sprintf("%d-%d", low, low*2-1)
+}
+
+// Call fn for every value along with its key, in key order. The trie must
+// not be modified during the walk.
+func (t *Trie) Walk(fn func(key string, value interface{})) {
+	t.root.walk(make([]string, 0, 8), t.sep, fn)
+}
+
+func (n *trieNode) walk(path []string, sep string, fn func(string, interface{})) {
+	if len(n.values) > 0 {
+		key := strings.Join(path, sep)
+		for _, value := range n.values {
+			fn(key, value)
+		}
+	}
+
+	names := make([]string, 0, len(n.Children))
+	for name, _ := range n.Children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		n.Children[name].walk(append(path, name), sep, fn)
+	}
+}
+
 var emptyNodeSlice = make([]*trieNode, 0, 0)
 
 type Matcher func(*trieNode, string) ([]*trieNode, []*trieNode)
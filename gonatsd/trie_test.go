@@ -151,3 +151,37 @@ func (s *TrieSuite) BenchmarkTrieBasicMatch(c *C) {
 		trie.Match("jjjjjjjjjj.iiiiiiiii.hhhhhhhh", BasicMatcher)
 	}
 }
+
+func (s *TrieSuite) TestTrieWalk(c *C) {
+	trie := NewTrie(".")
+	trie.Insert("foo.bar", "1")
+	trie.Insert("foo", "2")
+	trie.Insert("bar.*", "3")
+	trie.Insert("foo.bar", "4")
+
+	keys := make([]string, 0)
+	values := make([]interface{}, 0)
+	trie.Walk(func(key string, value interface{}) {
+		keys = append(keys, key)
+		values = append(values, value)
+	})
+	c.Check(keys, DeepEquals, []string{"bar.*", "foo", "foo.bar", "foo.bar"})
+	c.Check(values, DeepEquals, []interface{}{"3", "2", "1", "4"})
+}
+
+func (s *TrieSuite) TestTrieStats(c *C) {
+	trie := NewTrie(".")
+	stats := trie.Stats()
+	c.Check(stats.Depth, Equals, 0)
+	c.Check(stats.FanOut, DeepEquals, map[string]int{"0": 1})
+
+	trie.Insert("foo.a", "1")
+	trie.Insert("foo.b", "2")
+	trie.Insert("foo.c.d", "3")
+	trie.Insert("bar", "4")
+	stats = trie.Stats()
+	c.Check(stats.Nodes, Equals, 6)
+	c.Check(stats.Values, Equals, 4)
+	c.Check(stats.Depth, Equals, 3)
+	c.Check(stats.FanOut, DeepEquals, map[string]int{"0": 4, "1": 1, "2-3": 2})
+}
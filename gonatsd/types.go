@@ -2,10 +2,23 @@
 
 package gonatsd
 
+import (
+	"time"
+)
+
 type Message struct {
 	Subject string
 	ReplyTo string
 	Content []byte
+	Header  *Header // nil for messages without headers
+}
+
+// Returns the size of the message payload including the header block.
+func (m *Message) Size() int {
+	if m.Header != nil {
+		return len(m.Header.Raw) + len(m.Content)
+	}
+	return len(m.Content)
 }
 
 type Subscription struct {
@@ -13,12 +26,16 @@ type Subscription struct {
 	Subject      string
 	Queue        *string
 	Conn         Conn
+	Account      *Account
 	MaxResponses int
 	Responses    uint64
+	Headers      bool // the conn supported headers when it subscribed
 }
 
 type SubscribedMessage struct {
 	Subscription *Subscription
 	Message      *Message
 	Last         bool
+	Delivered    time.Time
+	Interest     *Response // SUB or UNSUB for a route, written instead of a message
 }
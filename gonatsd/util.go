@@ -3,6 +3,8 @@
 package gonatsd
 
 import (
+	"fmt"
+	"math/rand"
 	"strconv"
 	"strings"
 	"unicode"
@@ -90,3 +92,8 @@ func ensureValidSubscribedSubject(subject string) bool {
 	}
 	return true
 }
+
+// Returns a random server id, used to tell servers in a cluster apart.
+func newServerId() string {
+	return fmt.Sprintf("%016x", rand.Int63())
+}
@@ -0,0 +1,81 @@
+// Copyright (c) 2012 VMware, Inc.
+
+package gonatsd
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const (
+	VARZ_VERSION = 1
+
+	// Key of the value of a metric whose name is also the prefix of others,
+	// like "msg_recv" and "msg_recv.rate.10s".
+	VARZ_VALUE_KEY = "value"
+)
+
+// Server section of /varz.
+type VarzServer struct {
+	Info
+	Limits *LimitsConfig `json:"limits"`
+}
+
+// Nest the metrics into objects following their dotted names, with typed
+// values.
+func NewVarz(metrics map[string]fmt.Stringer) map[string]interface{} {
+	varz := make(map[string]interface{})
+	for name, metric := range metrics {
+		parts := strings.Split(name, ".")
+		node := varz
+		for _, part := range parts[:len(parts)-1] {
+			switch child := node[part].(type) {
+			case map[string]interface{}:
+				node = child
+			default:
+				nested := make(map[string]interface{})
+				if _, ok := node[part]; ok {
+					nested[VARZ_VALUE_KEY] = child
+				}
+				node[part] = nested
+				node = nested
+			}
+		}
+
+		last := parts[len(parts)-1]
+		if nested, ok := node[last].(map[string]interface{}); ok {
+			nested[VARZ_VALUE_KEY] = VarzValue(metric)
+		} else {
+			node[last] = VarzValue(metric)
+		}
+	}
+	return varz
+}
+
+// Returns the typed value of the metric: numbers for counters, gauges and
+// rates, nil when they have no value yet, an object for histograms and a
+// string for string values.
+func VarzValue(metric fmt.Stringer) interface{} {
+	switch metric.(type) {
+	case *StringVal:
+		return metric.String()
+	case *Counter:
+		return *metric.(*Counter).addr
+	case *Histogram:
+		return metric.(*Histogram).Snapshot()
+	}
+
+	value := metric.String()
+	if i, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return i
+	}
+	if f, err := strconv.ParseFloat(value, 64); err == nil && !math.IsNaN(f) && !math.IsInf(f, 0) {
+		return f
+	}
+	if _, ok := metric.(*Rate); ok || value == "N/A" {
+		return nil
+	}
+	return value
+}
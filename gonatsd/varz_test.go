@@ -0,0 +1,49 @@
+// Copyright (c) 2012 VMware, Inc.
+
+package gonatsd_test
+
+import (
+	"encoding/json"
+	"fmt"
+	. "gonatsd/gonatsd"
+	. "launchpad.net/gocheck"
+	"time"
+)
+
+type VarzSuite struct{}
+
+var _ = Suite(&VarzSuite{})
+
+func (s *VarzSuite) TestNewVarz(c *C) {
+	registry := NewRegistry(DEFAULT_RATE_UPDATE_INTERVAL)
+	count := int64(42)
+	registry.NewCounter("msg_recv", &count)
+	registry.NewRate("msg_recv.rate.10s", &count, 10*time.Second)
+	registry.NewGauge("runtime.heap_alloc", func() string { return "1024" })
+	registry.NewGauge("runtime.load", func() string { return "0.5" })
+	registry.NewStringVal("info.arch", "amd64")
+	histogram := NewHistogram(DEFAULT_HISTOGRAM_WINDOW)
+	histogram.Observe(3)
+	registry.AddHistogram("latency.publish_us", histogram)
+
+	var varz map[string]interface{}
+	registry.Metrics(func(metrics map[string]fmt.Stringer) {
+		varz = NewVarz(metrics)
+	})
+	payload, err := json.Marshal(varz)
+	c.Assert(err, IsNil)
+	c.Check(string(payload), Equals, `{"info":{"arch":"amd64"},`+
+		`"latency":{"publish_us":{"count":1,"p50":3,"p90":3,"p99":3,"max":3}},`+
+		`"msg_recv":{"rate":{"10s":null},"value":42},`+
+		`"runtime":{"heap_alloc":1024,"load":0.5}}`)
+}
+
+func (s *VarzSuite) TestVarzValue(c *C) {
+	registry := NewRegistry(DEFAULT_RATE_UPDATE_INTERVAL)
+	registry.NewGauge("na", func() string { return "N/A" })
+	registry.NewGauge("text", func() string { return "up" })
+	registry.Metrics(func(metrics map[string]fmt.Stringer) {
+		c.Check(VarzValue(metrics["na"]), IsNil)
+		c.Check(VarzValue(metrics["text"]), Equals, "up")
+	})
+}